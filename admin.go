@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func adminMain() {
+	switch cmd := flag.Arg(0); cmd {
+	case "", "builds":
+		listBuilds()
+	case "modules":
+		listModulesCmd()
+	default:
+		fmt.Fprintln(os.Stderr, "unknown admin command", cmd)
+		os.Exit(1)
+	}
+}
+
+// adminRequest sends hello to the daemon and decodes the response into out.
+func adminRequest(hello *Hello, out any) {
+	socketPath := filepath.Join(SocketDir, SocketFile)
+	c, err := net.Dial("unix", socketPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer c.Close()
+
+	if err := json.NewEncoder(c).Encode(hello); err != nil {
+		log.Fatalln(err)
+	}
+	if err := json.NewDecoder(c).Decode(out); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func listBuilds() {
+	var builds []BuildInfo
+	adminRequest(&Hello{Phase: PhaseList}, &builds)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BUILD\tNAME\tAGE\tCONNS\tSTATS\tDRV")
+	for _, b := range builds {
+		name := b.Name
+		if b.Verify {
+			name += " [verify]"
+		}
+		if b.Done {
+			name += " [done]"
+		}
+		age := time.Since(b.Started).Round(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", b.BuildID, name, age, b.Conns, b.Stats, b.DrvPath)
+	}
+	tw.Flush()
+}
+
+func listModulesCmd() {
+	var mods []ModuleInfo
+	adminRequest(&Hello{Phase: PhaseModules}, &mods)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODULE\tVERSION\tFILES\tSIZE")
+	for _, m := range mods {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Module, m.Version, strings.Join(m.Files, ","), formatBytes(m.Size))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reap a build with no connections after this much time
+	buildGrace = 2 * time.Hour
+	// how often to look for finished builds
+	reapInterval = time.Minute
+	// subdirectory of the build dir for quarantined puts
+	quarantineDir = "quarantine"
+	// files in the build dir that record the hook's hello, the uid that
+	// registered the build, and the uid that owns it, to survive restarts
+	helloFile   = ".hello.json"
+	hookUIDFile = ".hook-uid"
+	uidFile     = ".uid"
+	// subdirectory of the cache dir for namespaced caches
+	namespaceDir = "ns"
+)
+
+var validNamespace = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// buildTracker follows each build id from hook registration through its client
+// connections, and removes the build directory once the build is done.
+type buildTracker struct {
+	cacheDir   string
+	shared     *DiskCache
+	quarantine bool   // keep puts in the build until it succeeds
+	access     Access // server policy for all builds
+
+	verifySample float64 // fraction of builds to verify
+	verifyFail   bool    // fail puts that don't match the cache
+
+	lock   sync.Mutex
+	builds map[string]*buildState
+	byDrv  map[string]*buildState
+	caches map[string]*DiskCache // by namespace
+	kick   chan struct{}
+}
+
+type buildState struct {
+	id      string
+	dir     string
+	drvPath string // derivation being built, if the hook told us
+	name    string // pname or name of the derivation
+	started time.Time
+	sandbox string // sandbox root passed to the pre-build-hook, if any
+	options map[string]string
+
+	// watchSandbox is whether we could see the sandbox when we started
+	// tracking the build. With PrivateTmp we often can't, and then its
+	// absence means nothing.
+	watchSandbox bool
+
+	// cache is the shared cache for the build's namespace. noRead and noWrite
+	// opt out of reading from or writing to it.
+	cache   *DiskCache
+	noRead  bool
+	noWrite bool
+
+	// verify treats all gets as misses, and compares puts against what's
+	// already in the cache.
+	verify bool
+
+	// quarantine holds puts from this build until it's known to have
+	// succeeded, if QuarantinePuts is on.
+	quarantine *DiskCache
+
+	hookUID uint32 // uid that registered the build
+
+	// guarded by buildTracker.lock
+	uid      uint32 // uid of the first build-phase connection
+	uidBound bool
+	conns    int       // open build-phase connections
+	lastSeen time.Time // registration or last connection close
+	done     bool      // completion was signaled from the hook side
+	success  bool      // the hook side reported a successful build
+	stats    cacheStats
+
+	verifiedPuts int
+	mismatches   []verifyMismatch
+}
+
+// String identifies a build in logs.
+func (b *buildState) String() string {
+	if b.name != "" {
+		return b.id + " (" + b.name + ")"
+	} else if b.drvPath != "" {
+		return b.id + " (" + b.drvPath + ")"
+	}
+	return b.id
+}
+
+// cacheStats are cache counters for one connection or a whole build.
+type cacheStats struct {
+	Gets, GetHits, GetMisses, GetErrors int64
+	Puts, PutErrors                     int64
+}
+
+func (s *cacheStats) add(o cacheStats) {
+	s.Gets += o.Gets
+	s.GetHits += o.GetHits
+	s.GetMisses += o.GetMisses
+	s.GetErrors += o.GetErrors
+	s.Puts += o.Puts
+	s.PutErrors += o.PutErrors
+}
+
+func (s cacheStats) String() string {
+	return fmt.Sprintf("%d gets (%d hits, %d misses, %d errors); %d puts (%d errors)",
+		s.Gets, s.GetHits, s.GetMisses, s.GetErrors, s.Puts, s.PutErrors)
+}
+
+func newBuildTracker(cacheDir string, shared *DiskCache, cfg *Config) *buildTracker {
+	return &buildTracker{
+		cacheDir:   cacheDir,
+		shared:     shared,
+		quarantine: cfg.QuarantinePuts,
+		access:     cfg.Access,
+
+		verifySample: cfg.VerifySample,
+		verifyFail:   cfg.VerifyFail,
+		builds:       make(map[string]*buildState),
+		byDrv:        make(map[string]*buildState),
+		caches:       make(map[string]*DiskCache),
+		kick:         make(chan struct{}, 1),
+	}
+}
+
+// load adopts build directories left over from a previous server process, so
+// that builds in progress across a restart can keep connecting.
+func (bt *buildTracker) load() {
+	ents, err := os.ReadDir(bt.cacheDir)
+	if err != nil {
+		return
+	}
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	for _, ent := range ents {
+		if !ent.IsDir() || validBuildID(ent.Name()) != nil {
+			continue
+		}
+		dir := filepath.Join(bt.cacheDir, ent.Name())
+		var hello Hello
+		if hj, err := os.ReadFile(filepath.Join(dir, helloFile)); err == nil {
+			json.Unmarshal(hj, &hello)
+		}
+		b, err := bt.newBuild(ent.Name(), &hello)
+		if err != nil {
+			log.Printf("adopting build %s: %v", ent.Name(), err)
+			continue
+		}
+		if fi, err := ent.Info(); err == nil {
+			b.started, b.lastSeen = fi.ModTime(), fi.ModTime()
+		}
+		if qdir := filepath.Join(dir, quarantineDir); dirExists(qdir) {
+			b.quarantine = &DiskCache{Dir: qdir}
+		}
+		if uid, ok := readUID(filepath.Join(dir, uidFile)); ok {
+			b.uid, b.uidBound = uid, true
+		}
+		// without a record of who registered it, only root can finish it
+		b.hookUID, _ = readUID(filepath.Join(dir, hookUIDFile))
+		bt.add(b)
+	}
+}
+
+// register starts tracking a build registered by the hook running as uid.
+func (bt *buildTracker) register(id string, hello *Hello, uid uint32) (*buildState, error) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	if _, ok := bt.builds[id]; ok {
+		return nil, fmt.Errorf("build id %s already registered", id)
+	}
+	b, err := bt.newBuild(id, hello)
+	if err != nil {
+		return nil, err
+	}
+	b.hookUID = uid
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if _, err := writeAtomic(filepath.Join(b.dir, hookUIDFile), strings.NewReader(strconv.Itoa(int(uid)))); err != nil {
+		return nil, err
+	}
+	if hj, err := json.Marshal(hello); err != nil {
+		return nil, err
+	} else if _, err := writeAtomic(filepath.Join(b.dir, helloFile), bytes.NewReader(hj)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(b.cache.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	if !b.verify && bt.verifySample > 0 {
+		b.verify = rand.Float64() < bt.verifySample
+	}
+	if bt.quarantine && !b.noWrite {
+		b.quarantine = &DiskCache{Dir: filepath.Join(b.dir, quarantineDir)}
+		if err := os.Mkdir(b.quarantine.Dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	bt.add(b)
+	return b, nil
+}
+
+// newBuild makes a buildState from the hook's hello, applying the
+// per-derivation options. bt.lock must be held.
+func (bt *buildTracker) newBuild(id string, hello *Hello) (*buildState, error) {
+	b := &buildState{
+		id:       id,
+		dir:      filepath.Join(bt.cacheDir, id),
+		drvPath:  hello.DrvPath,
+		name:     hello.Name,
+		started:  time.Now(),
+		sandbox:  hello.Sandbox,
+		options:  hello.Options,
+		lastSeen: time.Now(),
+		noRead:   optionOff(hello.Options, "Read") || !bt.access.CanRead(),
+		noWrite:  optionOff(hello.Options, "Write") || !bt.access.CanWrite(),
+		verify:   optionOn(hello.Options, "Verify"),
+	}
+	// an adopted build whose sandbox is gone by now is reaped after
+	// buildGrace, like one we can't see
+	b.watchSandbox = b.sandbox != "" && !sandboxGone(b.sandbox)
+	access := Access(hello.Options["Access"])
+	if !access.Valid() {
+		return nil, fmt.Errorf("bad access %q", access)
+	}
+	b.noRead = b.noRead || !access.CanRead()
+	b.noWrite = b.noWrite || !access.CanWrite()
+	// the namespace comes from the derivation, so anything can ask for any
+	// namespace. it separates caches but doesn't protect them.
+	ns := hello.Options["Namespace"]
+	if ns == "" {
+		b.cache = bt.shared
+	} else if !validNamespace.MatchString(ns) {
+		return nil, fmt.Errorf("bad cache namespace %q", ns)
+	} else if b.cache = bt.caches[ns]; b.cache == nil {
+		b.cache = &DiskCache{
+			Dir:         filepath.Join(bt.cacheDir, namespaceDir, ns),
+			ManualATime: bt.shared.ManualATime,
+		}
+		bt.caches[ns] = b.cache
+	}
+	return b, nil
+}
+
+// add starts tracking b. bt.lock must be held.
+func (bt *buildTracker) add(b *buildState) {
+	bt.builds[b.id] = b
+	if b.drvPath != "" {
+		bt.byDrv[b.drvPath] = b
+	}
+}
+
+// connect records a build-phase connection from uid. The first uid to connect
+// with a build id owns it, so a build that learns another build's id can't use
+// it to read that build's files.
+func (bt *buildTracker) connect(id string, uid uint32) (*buildState, error) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	b, ok := bt.builds[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown build id %s, register with hook first", id)
+	}
+	if !b.uidBound {
+		uidFile := filepath.Join(b.dir, uidFile)
+		if _, err := writeAtomic(uidFile, strings.NewReader(strconv.Itoa(int(uid)))); err != nil {
+			return nil, err
+		}
+		b.uid, b.uidBound = uid, true
+	} else if b.uid != uid {
+		return nil, fmt.Errorf("build %s belongs to uid %d, not %d", b, b.uid, uid)
+	}
+	b.conns++
+	return b, nil
+}
+
+func (bt *buildTracker) disconnect(b *buildState, stats cacheStats) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	b.conns--
+	b.lastSeen = time.Now()
+	b.stats.add(stats)
+}
+
+// list describes the builds we're tracking, oldest first.
+func (bt *buildTracker) list() []BuildInfo {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	out := make([]BuildInfo, 0, len(bt.builds))
+	for _, b := range bt.builds {
+		out = append(out, BuildInfo{
+			BuildID: b.id,
+			Name:    b.name,
+			DrvPath: b.drvPath,
+			Started: b.started,
+			Conns:   b.conns,
+			Done:    b.done,
+			Verify:  b.verify,
+			Stats:   b.stats,
+		})
+	}
+	slices.SortFunc(out, func(a, b BuildInfo) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+func (bt *buildTracker) verified(b *buildState) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	b.verifiedPuts++
+}
+
+func (bt *buildTracker) mismatch(b *buildState, m verifyMismatch) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	b.mismatches = append(b.mismatches, m)
+}
+
+// finish marks a build as done, looking it up by build id or derivation path.
+// Unknown derivations are ignored, since the post-build-hook runs for all of
+// them. Either way, only the uid that registered a build can finish it, so
+// nothing else can get its directory reaped.
+func (bt *buildTracker) finish(id, drvPath string, success bool, uid uint32) error {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	b, ok := bt.builds[id]
+	if !ok && id != "" {
+		return fmt.Errorf("unknown build id %s", id)
+	} else if !ok {
+		if b, ok = bt.byDrv[drvPath]; !ok {
+			return nil
+		}
+	}
+	if uid != b.hookUID {
+		return fmt.Errorf("build %s was registered by uid %d, not %d", b, b.hookUID, uid)
+	}
+	b.done = true
+	b.success = success
+	select {
+	case bt.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (bt *buildTracker) reapLoop() {
+	tick := time.NewTicker(reapInterval)
+	for {
+		select {
+		case <-tick.C:
+		case <-bt.kick:
+		}
+		bt.reap()
+	}
+}
+
+// reap removes the directories of builds that are done: the hook side said so,
+// the sandbox we could see is gone, or nothing has connected for buildGrace.
+func (bt *buildTracker) reap() {
+	now := time.Now()
+	var dead []*buildState
+	bt.lock.Lock()
+	for id, b := range bt.builds {
+		if b.conns > 0 {
+			continue
+		}
+		if b.done || now.Sub(b.lastSeen) > buildGrace || b.watchSandbox && sandboxGone(b.sandbox) {
+			delete(bt.builds, id)
+			if bt.byDrv[b.drvPath] == b {
+				delete(bt.byDrv, b.drvPath)
+			}
+			dead = append(dead, b)
+		}
+	}
+	bt.lock.Unlock()
+
+	for _, b := range dead {
+		if b.stats.Gets > 0 || b.stats.Puts > 0 {
+			log.Printf("build %s done (success %v): %s", b, b.success, b.stats)
+		}
+		if b.verify {
+			log.Printf("build %s verified %d puts, %d mismatches", b, b.verifiedPuts, len(b.mismatches))
+			if err := bt.writeVerifyReport(b); err != nil {
+				log.Printf("writing verify report for %s: %v", b, err)
+			}
+		}
+		if b.quarantine != nil && b.success {
+			if n, err := b.cache.Promote(b.quarantine); err != nil {
+				log.Printf("promoting puts from %s: %v", b, err)
+			} else if n > 0 {
+				log.Printf("promoted %d puts from %s", n, b)
+			}
+		}
+		if err := os.RemoveAll(b.dir); err != nil {
+			log.Printf("removing build dir %s: %v", b.dir, err)
+		}
+	}
+}
+
+// sandboxGone reports whether a sandbox directory has definitely been removed.
+// The server usually can't look inside the sandbox parent, so if we get a
+// permission error, check the closest parent we can see instead.
+func sandboxGone(dir string) bool {
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		_, err := os.Stat(dir)
+		if err == nil {
+			return false
+		} else if errors.Is(err, os.ErrNotExist) {
+			return true
+		} else if !errors.Is(err, os.ErrPermission) {
+			return false
+		}
+	}
+	return false
+}
+
+// clean removes old files from the shared cache and all namespaces.
+func (bt *buildTracker) clean(ttl time.Duration) {
+	bt.shared.Clean(ttl)
+	ents, _ := os.ReadDir(filepath.Join(bt.cacheDir, namespaceDir))
+	for _, ent := range ents {
+		if ent.IsDir() && validNamespace.MatchString(ent.Name()) {
+			dc := &DiskCache{
+				Dir:         filepath.Join(bt.cacheDir, namespaceDir, ent.Name()),
+				ManualATime: bt.shared.ManualATime,
+			}
+			dc.Clean(ttl)
+		}
+	}
+}
+
+// optionOff reports whether a derivation option is present and turned off.
+func optionOff(opts map[string]string, key string) bool {
+	v, ok := opts[key]
+	return ok && (v == "" || v == "0" || v == "false")
+}
+
+// optionOn reports whether a derivation option is turned on.
+func optionOn(opts map[string]string, key string) bool {
+	_, ok := opts[key]
+	return ok && !optionOff(opts, key)
+}
+
+// readUID reads a uid written by register or connect.
+func readUID(file string) (uint32, bool) {
+	ub, err := os.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+	uid, err := strconv.ParseUint(string(ub), 10, 32)
+	return uint32(uid), err == nil
+}
+
+func dirExists(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
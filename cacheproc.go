@@ -20,14 +20,20 @@ import (
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Process implements the cmd/go JSON protocol over stdin & stdout via three
 // funcs that callers can optionally implement.
 type Process struct {
-	In       io.Reader
-	Out      io.Writer
-	CacheDir string
+	In     io.Reader
+	Out    io.Writer
+	Builds *buildTracker
+
+	// PeerUID is the uid of the other end of the connection, checked against
+	// Policy in setupBuild. If Policy is nil, nothing is checked.
+	PeerUID uint32
+	Policy  *peerPolicy
 
 	// Get optionally specifies a func to look up something from the cache. If
 	// nil, all gets are treated as cache misses.touch
@@ -63,6 +69,7 @@ type Process struct {
 
 	buildID  string
 	buildDir string
+	build    *buildState
 }
 
 func (p *Process) Run() error {
@@ -88,8 +95,23 @@ func (p *Process) Run() error {
 		}
 		return err
 	}
+	if p.build != nil {
+		defer func() { p.Builds.disconnect(p.build, p.Stats()) }()
+	}
 	// --- protocol extension
 
+	return p.serve(jd, bw, je)
+}
+
+// RunLocal is like Run but without the protocol extension, for a cache that
+// isn't shared through the server.
+func (p *Process) RunLocal() error {
+	br := bufio.NewReader(p.In)
+	bw := bufio.NewWriter(p.Out)
+	return p.serve(json.NewDecoder(br), bw, json.NewEncoder(bw))
+}
+
+func (p *Process) serve(jd *json.Decoder, bw *bufio.Writer, je *json.Encoder) error {
 	var caps []Cmd
 	if p.Get != nil {
 		caps = append(caps, "get")
@@ -110,6 +132,10 @@ func (p *Process) Run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// finish in-flight requests before returning
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
 	for {
 		var req Request
 		if err := jd.Decode(&req); err != nil {
@@ -135,7 +161,9 @@ func (p *Process) Run() error {
 			}
 			req.Body = bytes.NewReader(bodyb)
 		}
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			res := &Response{ID: req.ID}
 			ctx := ctx // TODO: include req ID as a context.Value for tracing?
 			if err := p.handleRequest(ctx, &req, res); err != nil {
@@ -149,6 +177,17 @@ func (p *Process) Run() error {
 	}
 }
 
+func (p *Process) Stats() cacheStats {
+	return cacheStats{
+		Gets:      p.Gets.Load(),
+		GetHits:   p.GetHits.Load(),
+		GetMisses: p.GetMisses.Load(),
+		GetErrors: p.GetErrors.Load(),
+		Puts:      p.Puts.Load(),
+		PutErrors: p.PutErrors.Load(),
+	}
+}
+
 func (p *Process) handleRequest(ctx context.Context, req *Request, res *Response) (retErr error) {
 	defer func() {
 		if retErr == nil {
@@ -185,7 +224,8 @@ func (p *Process) handleGet(ctx context.Context, req *Request, res *Response) (r
 		res.Miss = true
 		return nil
 	}
-	outputID, diskPath, err := p.Get(ctx, fmt.Sprintf("%x", req.ActionID))
+	info := &reqInfo{}
+	outputID, diskPath, err := p.Get(withReqInfo(ctx, info), fmt.Sprintf("%x", req.ActionID))
 	if err != nil {
 		return err
 	}
@@ -214,6 +254,7 @@ func (p *Process) handleGet(ctx context.Context, req *Request, res *Response) (r
 	res.Size = fi.Size()
 	res.TimeNanos = fi.ModTime().UnixNano()
 	res.DiskPath = diskPath
+	res.Cost = int64(info.Cost)
 	return nil
 }
 
@@ -223,7 +264,7 @@ func (p *Process) handlePut(ctx context.Context, req *Request, res *Response) (r
 	defer func() {
 		if retErr != nil {
 			p.PutErrors.Add(1)
-			log.Printf("put(action %s, obj %s, %v bytes): %v", actionID, outputID, req.BodySize, retErr)
+			log.Printf("%s: put(action %s, obj %s, %v bytes): %v", p.BuildLabel(), actionID, outputID, req.BodySize, retErr)
 		}
 	}()
 	if p.Put == nil {
@@ -236,6 +277,7 @@ func (p *Process) handlePut(ctx context.Context, req *Request, res *Response) (r
 	if body == nil {
 		body = bytes.NewReader(nil)
 	}
+	ctx = withReqInfo(ctx, &reqInfo{Cost: time.Duration(req.Cost)})
 	diskPath, err := p.Put(ctx, actionID, outputID, req.BodySize, body)
 	if err != nil {
 		return err
@@ -252,32 +294,121 @@ func (p *Process) handlePut(ctx context.Context, req *Request, res *Response) (r
 }
 
 // --- protocol extension
-func (p *Process) setupBuild(hello *Hello) (*HookResponse, error) {
-	if err := validBuildID(hello.BuildID); err != nil {
+
+// reqInfo carries protocol extension data between Process and its Get and
+// Put funcs, through the context.
+type reqInfo struct {
+	// Cost is how long the action took to build. Put gets it from the client
+	// and Get fills it in from the cache.
+	Cost time.Duration
+}
+
+type reqInfoKey struct{}
+
+func withReqInfo(ctx context.Context, info *reqInfo) context.Context {
+	return context.WithValue(ctx, reqInfoKey{}, info)
+}
+
+// getReqInfo returns the reqInfo in ctx, or a throwaway one if there isn't one.
+func getReqInfo(ctx context.Context) *reqInfo {
+	if info, ok := ctx.Value(reqInfoKey{}).(*reqInfo); ok {
+		return info
+	}
+	return &reqInfo{}
+}
+
+func (p *Process) setupBuild(hello *Hello) (any, error) {
+	if p.Policy != nil {
+		if err := p.Policy.check(p.PeerUID, hello.Phase); err != nil {
+			// logged by the caller
+			return nil, fmt.Errorf("rejected connection for build %q: %w", hello.BuildID, err)
+		}
+	}
+
+	if hello.Phase == PhaseList {
+		// this shows every build's id, so it's only for trusted peers, and
+		// never without a policy to say who they are
+		if p.Policy == nil {
+			return nil, errors.New("listing builds needs peer credential checks")
+		}
+		return p.Builds.list(), io.EOF
+	} else if hello.Phase == PhaseModules {
+		return listModules(p.Builds.shared.Dir), io.EOF
+	} else if hello.Phase == PhaseDone && hello.BuildID == "" {
+		// post-build-hook only knows the derivation path
+		if err := p.Builds.finish("", hello.DrvPath, hello.Success, p.PeerUID); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	} else if err := validBuildID(hello.BuildID); err != nil {
 		return nil, err
 	}
 
 	p.buildID = hello.BuildID
-	p.buildDir = filepath.Join(p.CacheDir, p.buildID)
 
 	switch hello.Phase {
 	case PhaseHook:
-		if err := os.MkdirAll(p.buildDir, 0o755); err != nil {
+		b, err := p.Builds.register(p.buildID, hello, p.PeerUID)
+		if err != nil {
 			return nil, err
 		}
+		p.build, p.buildDir = b, b.dir
 		return &HookResponse{BuildDir: p.buildDir}, io.EOF
 	case PhaseBuild:
-		if _, err := os.Stat(p.buildDir); err != nil {
-			return nil, fmt.Errorf("unknown build id %s, register with hook first (%w)", p.buildID, err)
+		if !hello.Access.Valid() {
+			return nil, fmt.Errorf("bad access %q", hello.Access)
+		}
+		b, err := p.Builds.connect(p.buildID, p.PeerUID)
+		if err != nil {
+			return nil, err
+		}
+		p.build, p.buildDir = b, b.dir
+		// without get, cmd/go treats everything as a miss. without put, it
+		// treats us as a read-only cache.
+		p.Get, p.Put = b.cache.Get, b.cache.Put
+		if b.noRead || !hello.Access.CanRead() {
+			p.Get = nil
+		}
+		if b.noWrite || !hello.Access.CanWrite() {
+			p.Put = nil
+		}
+		if b.quarantine != nil && p.Put != nil {
+			// see our own quarantined puts first, then the shared cache
+			shared := p.Get
+			p.Get = func(ctx context.Context, actionID string) (string, string, error) {
+				outputID, diskPath, err := b.quarantine.Get(ctx, actionID)
+				if err != nil || outputID != "" || shared == nil {
+					return outputID, diskPath, err
+				}
+				return shared(ctx, actionID)
+			}
+			p.Put = b.quarantine.Put
+		}
+		if b.verify {
+			p.Get = nil
+			p.Put = p.verifyPut(b.cache, p.Put)
 		}
 		return nil, nil
+	case PhaseDone:
+		if err := p.Builds.finish(p.buildID, hello.DrvPath, hello.Success, p.PeerUID); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
 	default:
 		return nil, errors.New("unknown phase in hello command")
 	}
 }
 
+// BuildLabel identifies the build this connection is for, in logs.
+func (p *Process) BuildLabel() string {
+	if p.build != nil {
+		return p.build.String()
+	}
+	return p.buildID
+}
+
 func (p *Process) linkToBuild(res *Response) error {
-	if res.DiskPath == "" {
+	if res.DiskPath == "" || p.buildDir == "" {
 		return nil
 	}
 	base := filepath.Base(res.DiskPath)
@@ -3,66 +3,120 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
-	"sync"
 )
 
-func initClient() *net.UnixConn {
-	// find build id
+// env var to request an Access mode for a connection
+const accessEnv = "nixGocacheprogAccess"
+
+// serverConn is a build-phase connection to the server.
+type serverConn struct {
+	uc   *net.UnixConn
+	br   *bufio.Reader
+	caps Response // first response from the server, with KnownCommands
+}
+
+func findBuildID() (string, error) {
 	dirents, err := os.ReadDir(SandboxCacheDir)
 	if err != nil {
-		log.Fatalln("readdir", SandboxCacheDir, err)
+		return "", err
 	}
-	var buildID string
 	for _, de := range dirents {
 		if de.IsDir() && validBuildID(de.Name()) == nil {
-			buildID = de.Name()
-			break
+			return de.Name(), nil
 		}
 	}
-	if buildID == "" {
-		log.Fatalln("can't find build id")
+	return "", errors.New("can't find build id")
+}
+
+func initClient() (*serverConn, error) {
+	buildID, err := findBuildID()
+	if err != nil {
+		return nil, err
 	}
 
 	// connect to server
 	socketPath := filepath.Join(SocketDir, SocketFile)
 	c, err := net.Dial("unix", socketPath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
 	// send hello with build id
 	bw := bufio.NewWriter(c)
 	je := json.NewEncoder(bw)
-	je.Encode(&Hello{BuildID: buildID, Phase: PhaseBuild})
-	bw.Flush()
+	// derivation attrs show up as env vars in the build
+	je.Encode(&Hello{BuildID: buildID, Phase: PhaseBuild, Access: Access(os.Getenv(accessEnv))})
+	if err := bw.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
 
-	return c.(*net.UnixConn)
+	// the server closes the connection if it doesn't like our hello, so wait
+	// for the first response before committing to it
+	sc := &serverConn{uc: c.(*net.UnixConn), br: bufio.NewReader(c)}
+	if line, err := sc.br.ReadBytes('\n'); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("server rejected build %s: %w", buildID, err)
+	} else if err := json.Unmarshal(line, &sc.caps); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sc, nil
 }
 
-func clientMain() {
-	uc := initClient()
+// newLocalProcess returns a Process with a private cache in a temporary
+// directory, for when the server isn't available, and a func to clean it up.
+// If it can't make a directory, all gets miss and puts are left to cmd/go.
+func newLocalProcess() (*Process, func()) {
+	p := &Process{}
+	dir, err := os.MkdirTemp("", "nix-gocacheprog-")
+	if err != nil {
+		return p, func() {}
+	}
+	dc := &DiskCache{Dir: dir}
+	p.Get, p.Put = dc.Get, dc.Put
+	return p, func() { os.RemoveAll(dir) }
+}
 
-	// transfer back and forth
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		defer uc.CloseWrite()
-		if _, err := io.Copy(uc, os.Stdin); err != nil {
-			log.Println("copy in error", err)
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		defer os.Stdout.Close()
-		if _, err := io.Copy(os.Stdout, uc); err != nil {
-			log.Println("copy out error", err)
+// runLocal speaks the cmd/go protocol itself, using newLocalProcess.
+func runLocal(in io.Reader, out io.Writer) error {
+	p, cleanup := newLocalProcess()
+	defer cleanup()
+	p.In, p.Out = in, out
+	return p.RunLocal()
+}
+
+// cacheClient returns a CacheClient for the proxy, relaying to the server if
+// it's available or else a local cache.
+func cacheClient() *CacheClient {
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	if sc, err := initClient(); err != nil {
+		log.Println("warning: shared module cache is off:", err)
+		go runLocal(reqR, resW)
+	} else {
+		go runRelay(sc, reqR, resW)
+	}
+	return NewCacheClient(resR, reqW)
+}
+
+func clientMain() {
+	sc, err := initClient()
+	if err != nil {
+		log.Println("warning: shared go build cache is off:", err)
+		if err := runLocal(os.Stdin, os.Stdout); err != nil {
+			log.Fatalln(err)
 		}
-	}()
-	wg.Wait()
+		return
+	}
+	if err := runRelay(sc, os.Stdin, os.Stdout); err != nil {
+		log.Fatalln(err)
+	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Config is read from ConfigFile, which module.nix writes from
+// services.nix-gocacheprog.settings. All fields are optional.
+type Config struct {
+	// QuarantinePuts keeps puts in the build directory and only adds them to
+	// the shared cache once the post-build-hook reports the build succeeded.
+	QuarantinePuts bool
+
+	// ChainHooks are other pre-build-hook programs to run, since nix only
+	// allows one. They get the same arguments, and their extra-sandbox-paths
+	// are merged with ours.
+	ChainHooks []string
+
+	// ChainPostHooks are other post-build-hook programs to run, for the same
+	// reason. They get the same arguments and environment.
+	ChainPostHooks []string
+
+	// Access limits what all builds may do with the cache: "read-write"
+	// (default), "read-only", or "write-only".
+	Access Access
+
+	// VerifySample is the fraction of builds (0 to 1) to run in verify mode,
+	// in addition to derivations that set nixGocacheprogVerify. Verify mode
+	// treats all gets as misses and compares puts against the cache. Reports
+	// are written to $CACHE_DIRECTORY/verify-reports.
+	VerifySample float64
+
+	// VerifyFail makes puts that don't match the cache fail, instead of only
+	// being logged and reported.
+	VerifyFail bool
+
+	// HookUIDs may register and finish builds, in addition to root (which
+	// nix-daemon runs the hooks as).
+	HookUIDs []uint32
+
+	// BuildGroup is the group whose members may connect as builds. The
+	// default is "nixbld".
+	BuildGroup string
+
+	// BuildUIDRanges are inclusive [first, last] uid ranges that may connect
+	// as builds. The default is the range nix uses for auto-allocate-uids.
+	BuildUIDRanges [][2]uint32
+}
+
+func loadConfig() (*Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(ConfigFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	} else if !cfg.Access.Valid() {
+		return nil, fmt.Errorf("bad access %q", cfg.Access)
+	}
+	return &cfg, nil
+}
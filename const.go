@@ -2,6 +2,7 @@ package main
 
 var (
 	SocketDir       = "<set in const.nix>"
+	ConfigFile      = "<set in const.nix>"
 	SandboxCacheDir = "<set in const.nix>"
 	ProxyListen     = "<set in const.nix>"
 )
@@ -9,8 +10,11 @@ var (
 const (
 	SocketFile = "sock"
 
-	PhaseBuild = "build"
-	PhaseHook  = "hook"
+	PhaseBuild   = "build"
+	PhaseHook    = "hook"
+	PhaseDone    = "done"
+	PhaseList    = "list"
+	PhaseModules = "modules"
 
 	BuildIDPrefix = "bld-"
 )
@@ -1,5 +1,6 @@
 {
   SocketDir = "/run/nix-gocacheprog";
+  ConfigFile = "/etc/nix-gocacheprog/config.json";
   SandboxCacheDir = "/gocache";
-  ProxyListen = ":8989";
+  ProxyListen = "127.0.0.1:0";
 }
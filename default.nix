@@ -3,9 +3,12 @@ pkgs.buildGoModule {
   pname = "nix-gocacheprog";
   version = "0.0.2";
   src = pkgs.lib.cleanSource ./.;
-  vendorHash = null;
+  vendorHash = null; # dependencies are in vendor/
   subPackages = [ "." ];
-  postInstall = "ln -s nix-gocacheprog $out/bin/hook";
+  postInstall = ''
+    ln -s nix-gocacheprog $out/bin/hook
+    ln -s nix-gocacheprog $out/bin/post-hook
+  '';
   env.CGO_ENABLED = "0";
   ldflags = pkgs.lib.mapAttrsToList (k: v: "-X main.${k}=${v}") (import ./const.nix);
 }
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/zip"
+)
+
+// derivation attr (so also env var) that maps module path prefixes to git
+// repos for direct fetches, e.g. "example.com/foo=https://git.example.com/foo.git".
+// Anything not listed here is found with the usual ?go-get=1 lookup.
+const reposEnv = "nixGocacheprogRepos"
+
+var errNotFound = errors.New("not found")
+
+// directUpstream stands in for "direct": it fetches modules from git and makes
+// up the same responses a proxy would give.
+type directUpstream struct {
+	repoMap map[string]string
+
+	lock  sync.Mutex
+	dir   string
+	repos map[string]*gitRepo // by url
+}
+
+type gitRepo struct {
+	url  string
+	dir  string
+	once sync.Once
+	err  error
+}
+
+func newDirectUpstream() *directUpstream {
+	d := &directUpstream{
+		repoMap: make(map[string]string),
+		repos:   make(map[string]*gitRepo),
+	}
+	for _, f := range strings.Fields(os.Getenv(reposEnv)) {
+		if prefix, url, ok := strings.Cut(f, "="); ok {
+			d.repoMap[prefix] = url
+		}
+	}
+	return d
+}
+
+func (d *directUpstream) String() string { return "direct" }
+
+// cleanup removes our clones.
+func (d *directUpstream) cleanup() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.dir != "" {
+		os.RemoveAll(d.dir)
+		d.dir = ""
+		d.repos = make(map[string]*gitRepo)
+	}
+}
+
+func (d *directUpstream) fetch(ctx context.Context, p string) (*http.Response, error) {
+	mod, kind, version, err := parseProxyPath(p)
+	if err != nil {
+		return textResponse(http.StatusNotFound, err.Error()), nil
+	}
+	body, err := d.serve(ctx, mod, kind, version)
+	if err != nil {
+		// let the go command try for itself, it has the rest of GOPROXY
+		log.Printf("direct %s: %v", p, err)
+		return textResponse(http.StatusNotFound, fmt.Sprintf("%s: %v", p, err)), nil
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": {strconv.Itoa(len(body))}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func (d *directUpstream) serve(ctx context.Context, mod, kind, version string) ([]byte, error) {
+	root, url, err := d.lookupRepo(ctx, mod)
+	if err != nil {
+		return nil, err
+	}
+	r, err := d.repo(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCodeRepo(r, mod, root)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "list":
+		return []byte(strings.Join(c.versions(ctx, ""), "\n")), nil
+	case "latest":
+		return c.latest(ctx)
+	case "info":
+		v, t, _, err := c.resolve(ctx, version)
+		if err != nil {
+			return nil, err
+		}
+		return infoJSON(v, t)
+	}
+
+	// .mod and .zip only take exact versions
+	if version != module.CanonicalVersion(version) {
+		return nil, fmt.Errorf("version %s is not canonical", version)
+	}
+	v, _, commit, err := c.resolve(ctx, version)
+	if err != nil {
+		return nil, err
+	} else if v != version {
+		return nil, fmt.Errorf("version %s resolves to %s", version, v)
+	}
+	dir := c.codeDir(ctx, commit)
+	if kind == "mod" {
+		gomod, err := r.git(ctx, "cat-file", "blob", commit+":"+path.Join(dir, "go.mod"))
+		if err != nil {
+			// no go.mod, make one up like the go command does
+			return []byte(fmt.Sprintf("module %s\n", mod)), nil
+		}
+		return gomod, nil
+	}
+	var buf bytes.Buffer
+	if err := zip.CreateFromVCS(&buf, module.Version{Path: mod, Version: version}, r.dir, commit, dir); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseProxyPath splits a module proxy path like
+// /golang.org/x/mod/@v/v0.22.0.zip into the module path, the kind of request
+// ("list", "info", "mod", "zip" or "latest"), and the version.
+func parseProxyPath(p string) (mod, kind, version string, err error) {
+	p = strings.TrimPrefix(p, "/")
+	var rest string
+	if escMod, ok := strings.CutSuffix(p, "/@latest"); ok {
+		mod, kind = escMod, "latest"
+	} else if escMod, ok := strings.CutSuffix(p, "/@v/list"); ok {
+		mod, kind = escMod, "list"
+	} else if escMod, file, ok := strings.Cut(p, "/@v/"); ok {
+		ext := filepath.Ext(file)
+		mod, kind, rest = escMod, strings.TrimPrefix(ext, "."), strings.TrimSuffix(file, ext)
+		if kind != "info" && kind != "mod" && kind != "zip" {
+			return "", "", "", fmt.Errorf("unknown proxy path %q", p)
+		}
+	} else {
+		return "", "", "", fmt.Errorf("unknown proxy path %q", p)
+	}
+	if mod, err = module.UnescapePath(mod); err != nil {
+		return "", "", "", err
+	}
+	if rest != "" {
+		if version, err = module.UnescapeVersion(rest); err != nil {
+			return "", "", "", err
+		}
+	}
+	return mod, kind, version, nil
+}
+
+func infoJSON(version string, t time.Time) ([]byte, error) {
+	return json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{version, t.UTC()})
+}
+
+var goImportRe = regexp.MustCompile(`<meta\s+name=["']?go-import["']?\s+content=["']([^"']*)["']`)
+
+// lookupRepo finds the git repo for a module, and the module path that
+// corresponds to the root of the repo.
+func (d *directUpstream) lookupRepo(ctx context.Context, mod string) (root, url string, err error) {
+	for prefix := range d.repoMap {
+		if (mod == prefix || strings.HasPrefix(mod, prefix+"/")) && len(prefix) > len(root) {
+			root = prefix
+		}
+	}
+	if root != "" {
+		return root, d.repoMap[root], nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+mod+"?go-get=1", nil)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", "", err
+	}
+	for _, m := range goImportRe.FindAllSubmatch(b, -1) {
+		f := strings.Fields(string(m[1]))
+		if len(f) < 3 || !(mod == f[0] || strings.HasPrefix(mod, f[0]+"/")) {
+			continue
+		} else if f[1] != "git" {
+			return "", "", fmt.Errorf("unsupported vcs %q for %s", f[1], mod)
+		}
+		return f[0], f[2], nil
+	}
+	return "", "", fmt.Errorf("no go-import meta tag for %s: %w", mod, errNotFound)
+}
+
+// repo returns a local clone of url, fetching it the first time.
+func (d *directUpstream) repo(ctx context.Context, url string) (*gitRepo, error) {
+	d.lock.Lock()
+	if d.dir == "" {
+		dir, err := os.MkdirTemp("", "nix-gocacheprog-git-")
+		if err != nil {
+			d.lock.Unlock()
+			return nil, err
+		}
+		d.dir = dir
+	}
+	r := d.repos[url]
+	if r == nil {
+		r = &gitRepo{url: url, dir: filepath.Join(d.dir, strconv.Itoa(len(d.repos)))}
+		d.repos[url] = r
+	}
+	d.lock.Unlock()
+
+	// other requests may be waiting for this, so don't let one going away stop it
+	r.once.Do(func() { r.err = r.clone(context.WithoutCancel(ctx)) })
+	return r, r.err
+}
+
+func (r *gitRepo) clone(ctx context.Context) error {
+	// zip.CreateFromVCS wants a repo with a .git dir, so not bare. we never
+	// check anything out.
+	if _, err := r.git(ctx, "init", "-q", "."); err != nil {
+		return err
+	}
+	// fetch branches as our own so queries like @master resolve. HEAD points
+	// to one of them but nothing is checked out, so that's ok.
+	_, err := r.git(ctx, "fetch", "-q", "--update-head-ok", r.url,
+		"+refs/heads/*:refs/heads/*",
+		"+refs/tags/*:refs/tags/*",
+		"+HEAD:refs/remotes/origin/HEAD")
+	return err
+}
+
+func (r *gitRepo) git(ctx context.Context, args ...string) ([]byte, error) {
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "PWD="+r.dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// codeRepo is one module in a git repo.
+type codeRepo struct {
+	r         *gitRepo
+	mod       string
+	pathMajor string // e.g. "/v2", or "" for v0/v1
+	dir       string // dir in the repo for the module, without the major version
+	tagPrefix string
+}
+
+func newCodeRepo(r *gitRepo, mod, root string) (*codeRepo, error) {
+	prefix, pathMajor, ok := module.SplitPathVersion(mod)
+	if !ok {
+		return nil, fmt.Errorf("invalid module path %q", mod)
+	}
+	dir := strings.TrimPrefix(strings.TrimPrefix(prefix, root), "/")
+	if prefix != root && !strings.HasPrefix(prefix, root+"/") {
+		// e.g. gopkg.in paths, where the major version is part of the root
+		dir = ""
+	}
+	c := &codeRepo{r: r, mod: mod, pathMajor: pathMajor, dir: dir}
+	if dir != "" {
+		c.tagPrefix = dir + "/"
+	}
+	return c, nil
+}
+
+// codeDir returns the dir holding the module at commit: either dir, or the
+// major version subdir of it if that has a go.mod.
+func (c *codeRepo) codeDir(ctx context.Context, commit string) string {
+	if strings.HasPrefix(c.pathMajor, "/") {
+		sub := path.Join(c.dir, c.pathMajor[1:])
+		if _, err := c.r.git(ctx, "cat-file", "-e", commit+":"+path.Join(sub, "go.mod")); err == nil {
+			return sub
+		}
+	}
+	return c.dir
+}
+
+// tagVersion returns the module version for a tag, or "" if the tag isn't a
+// release of this module. v2 and up without a go.mod, from before modules,
+// are +incompatible versions of the module without a major version suffix.
+func (c *codeRepo) tagVersion(ctx context.Context, tag string) string {
+	v, ok := strings.CutPrefix(tag, c.tagPrefix)
+	if !ok || v != semver.Canonical(v) || module.IsPseudoVersion(v) {
+		return ""
+	} else if module.MatchPathMajor(v, c.pathMajor) {
+		return v
+	} else if c.pathMajor != "" {
+		return ""
+	}
+	if _, err := c.r.git(ctx, "cat-file", "-e", "refs/tags/"+tag+":"+path.Join(c.dir, "go.mod")); err == nil {
+		return ""
+	}
+	return v + "+incompatible"
+}
+
+// tagRef returns the tag for a module version.
+func (c *codeRepo) tagRef(v string) string {
+	return "refs/tags/" + c.tagPrefix + strings.TrimSuffix(v, "+incompatible")
+}
+
+// versions lists the tagged versions of the module, only those reachable
+// from ref if it's not empty.
+func (c *codeRepo) versions(ctx context.Context, ref string) []string {
+	args := []string{"tag", "-l", c.tagPrefix + "v*"}
+	if ref != "" {
+		args = append(args, "--merged", ref)
+	}
+	out, err := c.r.git(ctx, args...)
+	if err != nil {
+		return nil
+	}
+	var vs []string
+	for _, tag := range strings.Fields(string(out)) {
+		if v := c.tagVersion(ctx, tag); v != "" {
+			vs = append(vs, v)
+		}
+	}
+	semver.Sort(vs)
+	return vs
+}
+
+func (c *codeRepo) latest(ctx context.Context) ([]byte, error) {
+	vs := c.versions(ctx, "")
+	// prefer the latest release over prereleases
+	for i := len(vs) - 1; i >= 0; i-- {
+		if semver.Prerelease(vs[i]) == "" {
+			vs = vs[:i+1]
+			break
+		}
+	}
+	query := "refs/remotes/origin/HEAD"
+	if len(vs) > 0 {
+		query = vs[len(vs)-1]
+	}
+	v, t, _, err := c.resolve(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return infoJSON(v, t)
+}
+
+// resolve turns a version or other query (branch, commit hash) into a module
+// version, its commit time, and the full commit hash.
+func (c *codeRepo) resolve(ctx context.Context, query string) (string, time.Time, string, error) {
+	if strings.HasPrefix(query, "-") {
+		// git would take it as an option
+		return "", time.Time{}, "", fmt.Errorf("%s: %w", query, errNotFound)
+	}
+	rev := query
+	if module.IsPseudoVersion(query) {
+		short, err := module.PseudoVersionRev(query)
+		if err != nil {
+			return "", time.Time{}, "", err
+		}
+		rev = short
+	} else if semver.IsValid(query) {
+		rev = c.tagRef(query)
+	}
+	out, err := c.r.git(ctx, "log", "-1", "--format=%H %ct", "--end-of-options", rev+"^{commit}", "--")
+	if err != nil {
+		return "", time.Time{}, "", fmt.Errorf("%s: %w", query, errNotFound)
+	}
+	hash, ct, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	sec, err := strconv.ParseInt(ct, 10, 64)
+	if err != nil {
+		return "", time.Time{}, "", err
+	}
+	t := time.Unix(sec, 0).UTC()
+
+	if module.IsPseudoVersion(query) {
+		if pt, err := module.PseudoVersionTime(query); err != nil || !pt.Equal(t) {
+			return "", time.Time{}, "", fmt.Errorf("%s: does not match commit time %s", query, t)
+		}
+		return query, t, hash, nil
+	} else if semver.IsValid(query) {
+		if c.tagVersion(ctx, strings.TrimPrefix(c.tagRef(query), "refs/tags/")) != query {
+			return "", time.Time{}, "", fmt.Errorf("%s: not a version of %s: %w", query, c.mod, errNotFound)
+		}
+		return query, t, hash, nil
+	}
+
+	// a branch or commit: use a tag on it if there is one, or make a pseudo-version
+	vs := c.versions(ctx, hash)
+	for i := len(vs) - 1; i >= 0; i-- {
+		if tagHash, err := c.r.git(ctx, "rev-parse", c.tagRef(vs[i])+"^{commit}"); err == nil &&
+			strings.TrimSpace(string(tagHash)) == hash {
+			return vs[i], t, hash, nil
+		}
+	}
+	var older string
+	if len(vs) > 0 {
+		older = vs[len(vs)-1]
+	}
+	major := strings.TrimPrefix(c.pathMajor, "/")
+	if major == "" || !semver.IsValid(major) {
+		major = ""
+	}
+	return module.PseudoVersion(major, older, t, hash[:12]), t, hash, nil
+}
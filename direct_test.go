@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+// makeRepo makes a bare git repo with a commit for each step, and tags on the
+// ones that have them. Steps without a go.mod remove it.
+func makeRepo(t *testing.T, dir string, steps []repoStep) string {
+	t.Helper()
+	bare := filepath.Join(dir, "repo.git")
+	work := filepath.Join(dir, "work")
+	git := func(dir string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	if err := os.MkdirAll(work, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	git(dir, "init", "-q", "--bare", "-b", "master", bare)
+	git(work, "init", "-q", "-b", "master")
+	for i, step := range steps {
+		gomod := filepath.Join(work, "go.mod")
+		if step.gomod != "" {
+			os.WriteFile(gomod, []byte(step.gomod), 0o644)
+		} else {
+			os.Remove(gomod)
+		}
+		os.WriteFile(filepath.Join(work, "a.go"), []byte("package a\n\nconst N = "+string(rune('0'+i))+"\n"), 0o644)
+		git(work, "add", "-A")
+		git(work, "commit", "-q", "-m", "step")
+		if step.tag != "" {
+			git(work, "tag", step.tag)
+		}
+	}
+	git(work, "push", "-q", "--tags", bare, "master")
+	return bare
+}
+
+type repoStep struct {
+	gomod string
+	tag   string
+}
+
+func TestDirect(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	// a module with a go.mod all along, and an older one from before modules
+	a := makeRepo(t, t.TempDir(), []repoStep{
+		{"module x.com/a\n", "v1.0.0"},
+		{"module x.com/a\n", "v1.1.0"},
+		{"module x.com/a\n", "v1.2.0-pre"},
+		{"module x.com/a\n", ""},
+	})
+	b := makeRepo(t, t.TempDir(), []repoStep{
+		{"", "v1.0.0"},
+		{"", "v2.0.0"},
+		{"", ""},
+	})
+	t.Setenv(reposEnv, "x.com/a="+a+" x.com/b="+b)
+
+	d := newDirectUpstream()
+	defer d.cleanup()
+	ctx := context.Background()
+	get := func(p string) (int, []byte) {
+		t.Helper()
+		res, err := d.fetch(ctx, p)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		return res.StatusCode, body
+	}
+	info := func(p string) string {
+		t.Helper()
+		code, body := get(p)
+		if code != http.StatusOK {
+			t.Fatalf("%s: %d %s", p, code, body)
+		}
+		var i struct{ Version string }
+		if err := json.Unmarshal(body, &i); err != nil {
+			t.Fatal(p, err)
+		}
+		return i.Version
+	}
+
+	// tags
+	if _, body := get("/x.com/a/@v/list"); string(body) != "v1.0.0\nv1.1.0\nv1.2.0-pre" {
+		t.Errorf("a list: %q", body)
+	}
+	if v := info("/x.com/a/@v/v1.0.0.info"); v != "v1.0.0" {
+		t.Errorf("a v1.0.0: %s", v)
+	}
+	if code, body := get("/x.com/a/@v/v1.1.0.mod"); code != http.StatusOK || string(body) != "module x.com/a\n" {
+		t.Errorf("a v1.1.0 mod: %d %q", code, body)
+	}
+	checkZip(t, get, "/x.com/a/@v/v1.1.0.zip", "x.com/a@v1.1.0/")
+	for _, p := range []string{"/x.com/a/@v/v9.0.0.info", "/x.com/a/@v/v1.0.zip", "/x.com/a/@v/v2.0.0+incompatible.info", "/x.com/a/@v/--output=x.info"} {
+		if code, _ := get(p); code != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", p, code)
+		}
+	}
+
+	// queries that look like options don't get to git
+	if files, _ := filepath.Glob(filepath.Join(d.dir, "*", "x*")); len(files) > 0 {
+		t.Errorf("git wrote %q", files)
+	}
+
+	// @latest prefers releases over prereleases
+	if v := info("/x.com/a/@latest"); v != "v1.1.0" {
+		t.Errorf("a latest: %s", v)
+	}
+
+	// pseudo-versions, after the prerelease
+	pseudo := info("/x.com/a/@v/master.info")
+	if !module.IsPseudoVersion(pseudo) || !strings.HasPrefix(pseudo, "v1.2.0-pre.0.") {
+		t.Fatalf("a master: %s", pseudo)
+	}
+	if v := info("/x.com/a/@v/" + pseudo + ".info"); v != pseudo {
+		t.Errorf("a %s: %s", pseudo, v)
+	}
+	checkZip(t, get, "/x.com/a/@v/"+pseudo+".zip", "x.com/a@"+pseudo+"/")
+
+	// +incompatible
+	if _, body := get("/x.com/b/@v/list"); string(body) != "v1.0.0\nv2.0.0+incompatible" {
+		t.Errorf("b list: %q", body)
+	}
+	if v := info("/x.com/b/@latest"); v != "v2.0.0+incompatible" {
+		t.Errorf("b latest: %s", v)
+	}
+	if v := info("/x.com/b/@v/v2.0.0+incompatible.info"); v != "v2.0.0+incompatible" {
+		t.Errorf("b v2.0.0+incompatible: %s", v)
+	}
+	if code, body := get("/x.com/b/@v/v2.0.0+incompatible.mod"); code != http.StatusOK || string(body) != "module x.com/b\n" {
+		t.Errorf("b v2.0.0+incompatible mod: %d %q", code, body)
+	}
+	checkZip(t, get, "/x.com/b/@v/v2.0.0+incompatible.zip", "x.com/b@v2.0.0+incompatible/")
+	if code, _ := get("/x.com/b/@v/v2.0.0.info"); code != http.StatusNotFound {
+		t.Errorf("b v2.0.0: %d, want 404", code)
+	}
+	pseudo = info("/x.com/b/@v/master.info")
+	if !module.IsPseudoVersion(pseudo) || !strings.HasPrefix(pseudo, "v2.0.1-0.") || !strings.HasSuffix(pseudo, "+incompatible") {
+		t.Fatalf("b master: %s", pseudo)
+	}
+	if v := info("/x.com/b/@v/" + pseudo + ".info"); v != pseudo {
+		t.Errorf("b %s: %s", pseudo, v)
+	}
+
+	// clones go away with the proxy
+	dir := d.dir
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	d.cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("clone dir still there: %v", err)
+	}
+}
+
+func checkZip(t *testing.T, get func(string) (int, []byte), p, prefix string) {
+	t.Helper()
+	code, body := get(p)
+	if code != http.StatusOK {
+		t.Fatalf("%s: %d %s", p, code, body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(p, err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if !slices.Contains(names, prefix+"a.go") {
+		t.Errorf("%s: files %q", p, names)
+	}
+}
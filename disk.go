@@ -11,6 +11,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -21,6 +22,7 @@ type indexEntry struct {
 	OutputID  string `json:"o"`
 	Size      int64  `json:"n"`
 	TimeNanos int64  `json:"t"`
+	Cost      int64  `json:"c,omitempty"` // nanoseconds to build, if known
 }
 
 type DiskCache struct {
@@ -53,21 +55,31 @@ func (dc *DiskCache) Get(ctx context.Context, actionID string) (outputID, diskPa
 	}
 	outputFile := filepath.Join(dc.Dir, fmt.Sprintf("o-%v", ie.OutputID))
 	dc.markAccess(outputFile)
+	getReqInfo(ctx).Cost = time.Duration(ie.Cost)
 	return ie.OutputID, outputFile, nil
 }
 
 func (dc *DiskCache) OutputFilename(outputID string) string {
-	if len(outputID) < 4 || len(outputID) > 1000 {
+	if !validID(outputID) {
 		return ""
 	}
-	for i := range outputID {
-		b := outputID[i]
+	return filepath.Join(dc.Dir, fmt.Sprintf("o-%s", outputID))
+}
+
+// validID reports whether id looks like an action or output id: lowercase hex
+// of a reasonable length.
+func validID(id string) bool {
+	if len(id) < 4 || len(id) > 1000 {
+		return false
+	}
+	for i := range id {
+		b := id[i]
 		if b >= '0' && b <= '9' || b >= 'a' && b <= 'f' {
 			continue
 		}
-		return ""
+		return false
 	}
-	return filepath.Join(dc.Dir, fmt.Sprintf("o-%s", outputID))
+	return true
 }
 
 func (dc *DiskCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
@@ -95,6 +107,7 @@ func (dc *DiskCache) Put(ctx context.Context, actionID, outputID string, size in
 		OutputID:  outputID,
 		Size:      size,
 		TimeNanos: time.Now().UnixNano(),
+		Cost:      int64(getReqInfo(ctx).Cost),
 	})
 	if err != nil {
 		return "", err
@@ -106,6 +119,51 @@ func (dc *DiskCache) Put(ctx context.Context, actionID, outputID string, size in
 	return file, nil
 }
 
+// Promote moves all entries from src into dc and returns how many it moved.
+// Objects are moved before their action files, so readers of dc never see an
+// action without its output.
+func (dc *DiskCache) Promote(src *DiskCache) (int, error) {
+	ents, err := os.ReadDir(src.Dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, ent := range ents {
+		// skip writeAtomic temp files, which look like a-<id>.<random>
+		name := ent.Name()
+		if id, ok := strings.CutPrefix(name, "a-"); !ok || !validID(id) {
+			continue
+		}
+		ij, err := os.ReadFile(filepath.Join(src.Dir, name))
+		if err != nil {
+			return n, err
+		}
+		var ie indexEntry
+		if err := json.Unmarshal(ij, &ie); err != nil {
+			continue
+		}
+		outputFile := src.OutputFilename(ie.OutputID)
+		if outputFile == "" {
+			continue
+		}
+		destFile := dc.OutputFilename(ie.OutputID)
+		if err := os.Rename(outputFile, destFile); os.IsNotExist(err) {
+			// another action with the same output may have moved it already,
+			// otherwise there's nothing to point the action at
+			if _, err := os.Stat(destFile); err != nil {
+				continue
+			}
+		} else if err != nil {
+			return n, err
+		}
+		if err := os.Rename(filepath.Join(src.Dir, name), filepath.Join(dc.Dir, name)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
 func (dc *DiskCache) Clean(ttl time.Duration) {
 	f, err := os.Open(dc.Dir)
 	if err != nil {
@@ -138,7 +196,7 @@ func (dc *DiskCache) markAccess(path string) {
 	if syscall.Stat(path, &st) != nil || now-st.Atim.Sec < 86400 {
 		return
 	}
-	_ = syscall.UtimesNano(path, []syscall.Timespec{{now, 0}, st.Mtim})
+	_ = syscall.UtimesNano(path, []syscall.Timespec{{Sec: now}, st.Mtim})
 }
 
 func writeAtomic(dest string, r io.Reader) (int64, error) {
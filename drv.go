@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// derivation attr that explicitly turns caching on ("1") or off ("0").
+	// other attrs starting with this are passed to the server as options.
+	enableAttr = "nixGocacheprog"
+	// name of the setup hook package in overlay.nix
+	hookName = "nix-gocacheprog-hook"
+)
+
+// Derivation is the part of a .drv file that the hook cares about.
+type Derivation struct {
+	Env   map[string]string
+	attrs map[string]json.RawMessage // from __json, if using structured attrs
+}
+
+// parseDerivation parses a derivation in nix's ATerm format, e.g.
+// Derive([outputs],[inputDrvs],[inputSrcs],"system","builder",[args],[env]).
+func parseDerivation(b []byte) (*Derivation, error) {
+	p := &atermParser{b: bytes.TrimSpace(b)}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	} else if p.i != len(p.b) {
+		return nil, fmt.Errorf("trailing data at offset %d", p.i)
+	}
+	cons, ok := v.(atermCons)
+	if !ok || (cons.name != "Derive" && cons.name != "DrvWithVersion") || len(cons.args) == 0 {
+		return nil, errors.New("not a derivation")
+	}
+
+	d := &Derivation{Env: make(map[string]string)}
+	env, _ := cons.args[len(cons.args)-1].([]any)
+	for _, kv := range env {
+		if kv, ok := kv.([]any); ok && len(kv) == 2 {
+			k, _ := kv[0].(string)
+			v, _ := kv[1].(string)
+			d.Env[k] = v
+		}
+	}
+	if js, ok := d.Env["__json"]; ok {
+		if err := json.Unmarshal([]byte(js), &d.attrs); err != nil {
+			return nil, fmt.Errorf("structured attrs: %w", err)
+		}
+	}
+	return d, nil
+}
+
+// Attr returns the value of a derivation attr as a string, looking in
+// structured attrs if present. Lists are joined with spaces, like nix does for
+// env vars.
+func (d *Derivation) Attr(name string) (string, bool) {
+	if d.attrs == nil {
+		v, ok := d.Env[name]
+		return v, ok
+	}
+	raw, ok := d.attrs[name]
+	if !ok {
+		return "", false
+	}
+	var s string
+	var list []string
+	var b bool
+	if json.Unmarshal(raw, &s) == nil {
+		return s, true
+	} else if json.Unmarshal(raw, &list) == nil {
+		return strings.Join(list, " "), true
+	} else if json.Unmarshal(raw, &b) == nil {
+		if b {
+			return "1", true
+		}
+		return "", true
+	}
+	return string(raw), true
+}
+
+// Name returns the pname of the derivation, or its name if it has no pname.
+func (d *Derivation) Name() string {
+	if pname, ok := d.Attr("pname"); ok && pname != "" {
+		return pname
+	}
+	name, _ := d.Attr("name")
+	return name
+}
+
+// WantsCache decides whether this derivation should get the cache: either it
+// says so with the enable attr, or it has our setup hook in nativeBuildInputs.
+func (d *Derivation) WantsCache() bool {
+	if v, ok := d.Attr(enableAttr); ok {
+		return v != "" && v != "0"
+	}
+	inputs, _ := d.Attr("nativeBuildInputs")
+	for _, input := range strings.Fields(inputs) {
+		// store path base names look like <hash>-<name>
+		if _, name, ok := strings.Cut(path.Base(input), "-"); ok && strings.HasPrefix(name, hookName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Options returns attrs that start with enableAttr, with the prefix
+// removed (e.g. nixGocacheprogFoo = "bar" becomes Foo: "bar").
+func (d *Derivation) Options() map[string]string {
+	var names []string
+	if d.attrs != nil {
+		for k := range d.attrs {
+			names = append(names, k)
+		}
+	} else {
+		for k := range d.Env {
+			names = append(names, k)
+		}
+	}
+	var opts map[string]string
+	for _, name := range names {
+		if opt, ok := strings.CutPrefix(name, enableAttr); ok && opt != "" {
+			if opts == nil {
+				opts = make(map[string]string)
+			}
+			opts[opt], _ = d.Attr(name)
+		}
+	}
+	return opts
+}
+
+// atermCons is a constructor application like Derive(...).
+type atermCons struct {
+	name string
+	args []any
+}
+
+// atermParser parses the subset of ATerm that nix uses: strings, lists,
+// tuples, and constructors. Lists and tuples are both returned as []any.
+type atermParser struct {
+	b []byte
+	i int
+}
+
+func (p *atermParser) value() (any, error) {
+	if p.i >= len(p.b) {
+		return nil, errors.New("unexpected end of derivation")
+	}
+	switch c := p.b[p.i]; {
+	case c == '"':
+		return p.str()
+	case c == '[':
+		return p.seq('[', ']')
+	case c == '(':
+		return p.seq('(', ')')
+	case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		start := p.i
+		for p.i < len(p.b) && p.b[p.i] != '(' {
+			p.i++
+		}
+		name := string(p.b[start:p.i])
+		args, err := p.seq('(', ')')
+		if err != nil {
+			return nil, err
+		}
+		return atermCons{name: name, args: args}, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, p.i)
+	}
+}
+
+func (p *atermParser) seq(open, close byte) ([]any, error) {
+	if p.i >= len(p.b) || p.b[p.i] != open {
+		return nil, fmt.Errorf("expected %q at offset %d", open, p.i)
+	}
+	p.i++
+	var out []any
+	for {
+		if p.i >= len(p.b) {
+			return nil, errors.New("unexpected end of derivation")
+		} else if p.b[p.i] == close {
+			p.i++
+			return out, nil
+		} else if len(out) > 0 {
+			if p.b[p.i] != ',' {
+				return nil, fmt.Errorf("expected ',' at offset %d", p.i)
+			}
+			p.i++
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+}
+
+func (p *atermParser) str() (string, error) {
+	p.i++ // opening quote
+	var sb strings.Builder
+	for p.i < len(p.b) {
+		c := p.b[p.i]
+		p.i++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.i >= len(p.b) {
+				return "", errors.New("unexpected end of derivation")
+			}
+			c = p.b[p.i]
+			p.i++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			}
+		}
+		sb.WriteByte(c)
+	}
+	return "", errors.New("unterminated string in derivation")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+// testDrv makes a derivation in ATerm format with env, the way nix writes
+// them.
+func testDrv(cons string, env ...string) string {
+	esc := strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	var sb strings.Builder
+	sb.WriteString(cons + `(`)
+	if cons == "DrvWithVersion" {
+		sb.WriteString(`"xp-dyn-drv",`)
+	}
+	sb.WriteString(`[("out","/nix/store/aaaa-foo-1.0","","")],[("/nix/store/bbbb-go-1.22.drv",["out"])],["/nix/store/cccc-source"],"x86_64-linux","/nix/store/dddd-bash/bin/bash",["-e","/nix/store/eeee-default-builder.sh"],[`)
+	for i := 0; i+1 < len(env); i += 2 {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(`("` + esc.Replace(env[i]) + `","` + esc.Replace(env[i+1]) + `")`)
+	}
+	sb.WriteString("])")
+	return sb.String()
+}
+
+func TestParseDerivation(t *testing.T) {
+	const hook = "/nix/store/ffff-go-1.22 /nix/store/gggg-nix-gocacheprog-hook"
+	for _, tc := range []struct {
+		name      string
+		drv       string
+		wantErr   bool
+		wantName  string
+		wantCache bool
+		wantOpts  map[string]string
+		wantEnv   map[string]string // some env vars to check
+	}{
+		{
+			name:     "plain",
+			drv:      testDrv("Derive", "name", "foo-1.0", "pname", "foo", "nativeBuildInputs", "/nix/store/ffff-go-1.22"),
+			wantName: "foo",
+		},
+		{
+			name:      "hook",
+			drv:       testDrv("Derive", "name", "foo-1.0", "nativeBuildInputs", hook),
+			wantName:  "foo-1.0",
+			wantCache: true,
+		},
+		{
+			name:     "not quite the hook",
+			drv:      testDrv("Derive", "name", "foo", "nativeBuildInputs", "/nix/store/ffff-not-nix-gocacheprog-hook"),
+			wantName: "foo",
+		},
+		{
+			name:      "enabled",
+			drv:       testDrv("Derive", "name", "foo", "nixGocacheprog", "1"),
+			wantName:  "foo",
+			wantCache: true,
+		},
+		{
+			name:     "disabled",
+			drv:      testDrv("Derive", "name", "foo", "nativeBuildInputs", hook, "nixGocacheprog", "0"),
+			wantName: "foo",
+		},
+		{
+			name:      "options",
+			drv:       testDrv("Derive", "name", "foo", "nativeBuildInputs", hook, "nixGocacheprogNamespace", "ns", "nixGocacheprogRead", "0", "nixGocacheprogVerify", "1"),
+			wantName:  "foo",
+			wantCache: true,
+			wantOpts:  map[string]string{"Namespace": "ns", "Read": "0", "Verify": "1"},
+		},
+		{
+			name:     "escapes",
+			drv:      `Derive([],[],[],"x86_64-linux","/bin/sh",[],[("name","foo"),("script","echo \"a\\b\"\n\tdone")])`,
+			wantName: "foo",
+			wantEnv:  map[string]string{"script": "echo \"a\\b\"\n\tdone"},
+		},
+		{
+			name:      "with version",
+			drv:       testDrv("DrvWithVersion", "name", "foo", "nativeBuildInputs", hook),
+			wantName:  "foo",
+			wantCache: true,
+		},
+		{
+			name: "structured attrs",
+			drv: testDrv("Derive", "__json", `{"name":"foo-1.0","pname":"foo","nativeBuildInputs":["/nix/store/ffff-go-1.22","/nix/store/gggg-nix-gocacheprog-hook"],`+
+				`"nixGocacheprogNamespace":"ns","nixGocacheprogVerify":true,"nixGocacheprogWrite":false,"nixGocacheprogN":3}`,
+				"out", "/nix/store/aaaa-foo-1.0"),
+			wantName:  "foo",
+			wantCache: true,
+			wantOpts:  map[string]string{"Namespace": "ns", "Verify": "1", "Write": "", "N": "3"},
+		},
+		{
+			name:     "structured attrs disabled",
+			drv:      testDrv("Derive", "__json", `{"name":"foo","nativeBuildInputs":["/nix/store/gggg-nix-gocacheprog-hook"],"nixGocacheprog":false}`),
+			wantName: "foo",
+		},
+		{name: "bad structured attrs", drv: testDrv("Derive", "__json", "{"), wantErr: true},
+		{name: "not a derivation", drv: `Foo([])`, wantErr: true},
+		{name: "trailing data", drv: testDrv("Derive", "name", "foo") + "x", wantErr: true},
+		{name: "unterminated", drv: `Derive([],[],[],"x86_64-linux`, wantErr: true},
+		{name: "bad escape at end", drv: `Derive([("a\`, wantErr: true},
+		{name: "missing comma", drv: `Derive([]["a"])`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := parseDerivation([]byte(tc.drv))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := d.Name(); got != tc.wantName {
+				t.Errorf("name %q, want %q", got, tc.wantName)
+			}
+			if got := d.WantsCache(); got != tc.wantCache {
+				t.Errorf("wants cache %v, want %v", got, tc.wantCache)
+			}
+			if got := d.Options(); !maps.Equal(got, tc.wantOpts) {
+				t.Errorf("options %q, want %q", got, tc.wantOpts)
+			}
+			for k, want := range tc.wantEnv {
+				if got := d.Env[k]; got != want {
+					t.Errorf("env %s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// Cached proxy responses are stored as entryMagic, a big-endian uint32
+// length, that many bytes of JSON entryMeta, and then the body.
+//
+// Older entries are a JSON http.Header padded with newlines to
+// legacyHeaderSize bytes, followed by the body. We can still read those.
+var entryMagic = []byte("NGCP\x02")
+
+const legacyHeaderSize = 4096
+
+// header that legacy entries used for when they were fetched
+const legacyFetchedHeader = "Nix-Gocacheprog-Fetched"
+
+// largest entryMeta we'll read
+const maxEntryMeta = 1 << 20
+
+// headers worth keeping from upstream responses
+var keptHeaders = []string{"Content-Type", "ETag", "Last-Modified"}
+
+type entryMeta struct {
+	Header http.Header `json:",omitempty"`
+	// when it was fetched. we don't write this anymore, since it made
+	// refetches of the same content different objects; the object's mtime is
+	// used instead.
+	Fetched time.Time
+	// what it is, for listing cached modules
+	Module  string `json:",omitempty"`
+	Version string `json:",omitempty"`
+	Kind    string `json:",omitempty"`
+}
+
+// cacheEntry is an open cached response.
+type cacheEntry struct {
+	f       *os.File // positioned at the start of the body
+	header  http.Header
+	fetched time.Time // zero if unknown
+	expired bool
+}
+
+// encodeEntryPrefix returns what goes before the body in a cache entry, with
+// the kept headers from header added to meta.
+func encodeEntryPrefix(meta entryMeta, header http.Header) ([]byte, error) {
+	meta.Header = make(http.Header)
+	for _, k := range keptHeaders {
+		if vs := header.Values(k); len(vs) > 0 {
+			meta.Header[http.CanonicalHeaderKey(k)] = vs
+		}
+	}
+	js, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(entryMagic)+4+len(js))
+	buf = append(buf, entryMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(js)))
+	return append(buf, js...), nil
+}
+
+// readCacheEntry reads the prefix of a cache entry of the given size, leaving
+// f at the start of the body.
+func readCacheEntry(f *os.File, size int64) (*cacheEntry, error) {
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if size != fi.Size() {
+		return nil, fmt.Errorf("mismatched cache size and disk size: %d != %d", size, fi.Size())
+	}
+
+	pre := make([]byte, len(entryMagic)+4)
+	if _, err := io.ReadFull(f, pre); err != nil {
+		return nil, err
+	} else if !bytes.HasPrefix(pre, entryMagic) {
+		return readLegacyEntry(f, size)
+	}
+	n := binary.BigEndian.Uint32(pre[len(entryMagic):])
+	if n > maxEntryMeta {
+		return nil, fmt.Errorf("cache entry metadata too big: %d", n)
+	}
+	js := make([]byte, n)
+	if _, err := io.ReadFull(f, js); err != nil {
+		return nil, err
+	}
+	var meta entryMeta
+	if err := json.Unmarshal(js, &meta); err != nil {
+		return nil, err
+	}
+	bodySize := size - int64(len(pre)) - int64(n)
+	if bodySize < 0 {
+		return nil, errors.New("truncated cache entry")
+	}
+	if meta.Header == nil {
+		meta.Header = make(http.Header)
+	}
+	meta.Header.Set("Content-Length", strconv.FormatInt(bodySize, 10))
+	return &cacheEntry{f: f, header: meta.Header, fetched: meta.Fetched}, nil
+}
+
+func readLegacyEntry(f *os.File, size int64) (*cacheEntry, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hbuf := make([]byte, legacyHeaderSize)
+	if _, err := io.ReadFull(f, hbuf); err != nil {
+		return nil, err
+	}
+	var headers http.Header
+	if err := json.Unmarshal(hbuf, &headers); err != nil {
+		return nil, err
+	}
+
+	if cl, err := strconv.Atoi(headers.Get("Content-Length")); err != nil {
+		// this should be there, but if not fill it in
+		headers.Set("Content-Length", strconv.Itoa(int(size)-legacyHeaderSize))
+	} else if cl != int(size)-legacyHeaderSize {
+		return nil, fmt.Errorf("cache had wrong Content-Length header: %d != %d", cl, size-legacyHeaderSize)
+	}
+	ent := &cacheEntry{f: f, header: headers}
+	if t, err := time.Parse(time.RFC3339Nano, headers.Get(legacyFetchedHeader)); err == nil {
+		ent.fetched = t
+	}
+	headers.Del(legacyFetchedHeader)
+	return ent, nil
+}
+
+// readEntryMeta reads the metadata of a cache entry file, if it's in the
+// current format.
+func readEntryMeta(path string) (*entryMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pre := make([]byte, len(entryMagic)+4)
+	if _, err := io.ReadFull(f, pre); err != nil {
+		return nil, err
+	} else if !bytes.HasPrefix(pre, entryMagic) {
+		return nil, errors.New("not a proxy cache entry")
+	}
+	n := binary.BigEndian.Uint32(pre[len(entryMagic):])
+	if n > maxEntryMeta {
+		return nil, fmt.Errorf("cache entry metadata too big: %d", n)
+	}
+	var meta entryMeta
+	if err := json.NewDecoder(io.LimitReader(f, int64(n))).Decode(&meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// listModules finds the module versions with proxy files in a cache dir.
+// Entries from before we recorded the module aren't listed.
+func listModules(dir string) []ModuleInfo {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	byVersion := make(map[string]*ModuleInfo)
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.Name(), "o-") {
+			continue
+		}
+		meta, err := readEntryMeta(filepath.Join(dir, ent.Name()))
+		if err != nil || meta.Module == "" || meta.Version == "" {
+			continue
+		}
+		key := meta.Module + "@" + meta.Version
+		mi := byVersion[key]
+		if mi == nil {
+			mi = &ModuleInfo{Module: meta.Module, Version: meta.Version}
+			byVersion[key] = mi
+		}
+		if !slices.Contains(mi.Files, meta.Kind) {
+			mi.Files = append(mi.Files, meta.Kind)
+		}
+		if fi, err := ent.Info(); err == nil {
+			mi.Size += fi.Size()
+		}
+	}
+
+	out := make([]ModuleInfo, 0, len(byVersion))
+	for _, mi := range byVersion {
+		slices.Sort(mi.Files)
+		out = append(out, *mi)
+	}
+	slices.SortFunc(out, func(a, b ModuleInfo) int {
+		if c := strings.Compare(a.Module, b.Module); c != 0 {
+			return c
+		}
+		return semver.Compare(a.Version, b.Version)
+	})
+	return out
+}
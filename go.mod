@@ -1,3 +1,5 @@
 module github.com/dnr/nix-gocacheprog
 
-go 1.22
+go 1.22.0
+
+require golang.org/x/mod v0.22.0
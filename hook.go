@@ -8,27 +8,81 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"regexp"
+	"strings"
 )
 
-const dependsOnUs = `"nativeBuildInputs","[^"]*nix-gocacheprog-hook`
+// readDrv returns the derivation at drvPath if it wants the cache, or nil.
+func readDrv(drvPath string) *Derivation {
+	b, err := os.ReadFile(drvPath)
+	if err != nil {
+		log.Println("can't open", drvPath)
+		return nil // just ignore errors
+	}
+	drv, err := parseDerivation(b)
+	if err != nil {
+		log.Println("can't parse", drvPath, err)
+		return nil
+	} else if !drv.WantsCache() {
+		return nil // does not depend on this hook
+	}
+	return drv
+}
 
 func hookMain() {
 	if flag.NArg() < 1 {
 		return // not called as a hook properly?
-	} else if drv, err := os.ReadFile(flag.Arg(0)); err != nil {
-		log.Println("can't open", flag.Arg(0))
-		return // just ignore errors
-	} else if ok, err := regexp.Match(dependsOnUs, drv); err != nil || !ok {
-		return // does not depend on this hook
 	}
 
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Println("load config:", err)
+		cfg = &Config{}
+	}
+
+	failed := false
+	var paths []string
+	if drv := readDrv(flag.Arg(0)); drv != nil {
+		if ours, err := registerBuild(drv); err != nil {
+			// the build still works without the cache, just slower
+			log.Println("nix-gocacheprog:", err)
+		} else {
+			paths = append(paths, ours...)
+		}
+	}
+	for _, hook := range cfg.ChainHooks {
+		more, err := runChainedHook(hook, flag.Args())
+		if err != nil {
+			log.Printf("chained hook %s: %v", hook, err)
+			failed = true
+			continue
+		}
+		paths = append(paths, more...)
+	}
+
+	if len(paths) > 0 {
+		bw := bufio.NewWriter(os.Stdout)
+		fmt.Fprintf(bw, "extra-sandbox-paths\n")
+		for _, p := range paths {
+			fmt.Fprintf(bw, "%s\n", p)
+		}
+		bw.Flush()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// registerBuild registers a new build id with the server and returns the
+// sandbox paths needed for it.
+func registerBuild(drv *Derivation) ([]string, error) {
 	socketPath := filepath.Join(SocketDir, SocketFile)
 	c, err := net.Dial("unix", socketPath)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
+	defer c.Close()
 
 	br := bufio.NewReader(c)
 	jd := json.NewDecoder(br)
@@ -36,23 +90,116 @@ func hookMain() {
 	je := json.NewEncoder(bw)
 
 	id := genBuildID()
-	je.Encode(&Hello{BuildID: id, Phase: PhaseHook})
+	// nix passes the sandbox root as the second argument when sandboxing is on
+	je.Encode(&Hello{
+		BuildID: id,
+		Phase:   PhaseHook,
+		DrvPath: flag.Arg(0),
+		Name:    drv.Name(),
+		Sandbox: flag.Arg(1),
+		Options: drv.Options(),
+	})
 	bw.Flush()
 
 	var res HookResponse
 	if err := jd.Decode(&res); err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
 	selfBin, err := os.Readlink("/proc/self/exe")
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
-	bw = bufio.NewWriter(os.Stdout)
-	fmt.Fprintf(bw, "extra-sandbox-paths\n")
-	fmt.Fprintf(bw, "%s\n", SocketDir)
-	fmt.Fprintf(bw, "%s/%s=%s\n", SandboxCacheDir, id, res.BuildDir)
-	fmt.Fprintf(bw, "%s/client=%s\n", SandboxCacheDir, selfBin)
-	bw.Flush()
+	return []string{
+		SocketDir,
+		fmt.Sprintf("%s/%s=%s", SandboxCacheDir, id, res.BuildDir),
+		fmt.Sprintf("%s/client=%s", SandboxCacheDir, selfBin),
+	}, nil
+}
+
+// runChainedHook runs another pre-build-hook with our arguments and returns
+// the extra-sandbox-paths it asked for.
+func runChainedHook(hook string, args []string) ([]string, error) {
+	cmd := exec.Command(hook, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseHookOutput(out)
+}
+
+// parseHookOutput parses pre-build-hook output the same way nix does.
+func parseHookOutput(out []byte) ([]string, error) {
+	var paths []string
+	inPaths := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		if inPaths {
+			if line == "" {
+				inPaths = false
+			} else {
+				paths = append(paths, line)
+			}
+		} else if line == "extra-sandbox-paths" || line == "extra-chroot-dirs" {
+			inPaths = true
+		} else if line != "" {
+			return nil, fmt.Errorf("unknown pre-build hook command %q", line)
+		}
+	}
+	return paths, nil
+}
+
+// postHookMain runs as nix's post-build-hook, which only runs after successful
+// builds. It can also be called by hand with a build id or derivation path.
+// Failing a post-build-hook fails the build, so our part never exits with an
+// error; chained hooks can still fail it.
+func postHookMain() {
+	finishBuild()
+
+	if flag.NArg() > 0 {
+		return // called by hand
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Println("load config:", err)
+		return
+	}
+	failed := false
+	for _, hook := range cfg.ChainPostHooks {
+		cmd := exec.Command(hook)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("chained post-build-hook %s: %v", hook, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// finishBuild tells the server that the build in DRV_PATH, or the one named by
+// the argument, is done.
+func finishBuild() {
+	hello := Hello{Phase: PhaseDone, DrvPath: os.Getenv("DRV_PATH"), Success: true}
+	if arg := flag.Arg(0); validBuildID(arg) == nil {
+		hello.BuildID = arg
+	} else if arg != "" {
+		hello.DrvPath = arg
+	}
+	if hello.BuildID == "" && (hello.DrvPath == "" || readDrv(hello.DrvPath) == nil) {
+		return
+	}
+
+	socketPath := filepath.Join(SocketDir, SocketFile)
+	c, err := net.Dial("unix", socketPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer c.Close()
+	if err := json.NewEncoder(c).Encode(&hello); err != nil {
+		log.Println(err)
+	}
 }
@@ -8,7 +8,7 @@ import (
 )
 
 func main() {
-	mode := flag.String("mode", "auto", "which mode to run (client, server, hook, goproxy)")
+	mode := flag.String("mode", "auto", "which mode to run (client, server, hook, post-hook, goproxy, admin)")
 	flag.Parse()
 
 	if *mode == "auto" {
@@ -22,8 +22,12 @@ func main() {
 		serverMain()
 	case "hook":
 		hookMain()
+	case "post-hook":
+		postHookMain()
 	case "goproxy":
 		proxyMain()
+	case "admin":
+		adminMain()
 	default:
 		fmt.Fprintln(os.Stderr, "unknown mode", *mode)
 		os.Exit(1)
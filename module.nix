@@ -2,23 +2,38 @@
 let
   pkg = import ./. { inherit pkgs; };
   const = import ./const.nix;
+  cfg = config.services.nix-gocacheprog;
+  configFile = lib.removePrefix "/etc/" const.ConfigFile;
 in
 {
-  nix.settings.pre-build-hook = "${pkg}/bin/hook";
-
-  systemd.sockets.nix-gocacheprog = {
-    description = "Server for Nix Go caching";
-    wantedBy = [ "sockets.target" ];
-    socketConfig.ListenStream = "${const.SocketDir}/sock";
+  options.services.nix-gocacheprog.settings = lib.mkOption {
+    type = lib.types.attrs;
+    default = {};
+    description = "Settings for nix-gocacheprog, see Config in config.go.";
   };
 
-  systemd.services.nix-gocacheprog = {
-    description = "Server for Nix Go caching";
-    path = [ pkgs.util-linux ]; # for findmnt
-    serviceConfig = {
-      ExecStart = "${pkg}/bin/nix-gocacheprog -mode server";
-      CacheDirectory = "nix-gocacheprog";
-      DynamicUser = "true";
+  config = {
+    environment.etc.${configFile}.text = builtins.toJSON cfg.settings;
+
+    # nix only allows one of each; others go in ChainHooks and ChainPostHooks
+    nix.settings.pre-build-hook = "${pkg}/bin/hook";
+    nix.settings.post-build-hook = "${pkg}/bin/post-hook";
+
+    systemd.sockets.nix-gocacheprog = {
+      description = "Server for Nix Go caching";
+      wantedBy = [ "sockets.target" ];
+      socketConfig.ListenStream = "${const.SocketDir}/sock";
+    };
+
+    systemd.services.nix-gocacheprog = {
+      description = "Server for Nix Go caching";
+      path = [ pkgs.util-linux ]; # for findmnt
+      restartTriggers = [ config.environment.etc.${configFile}.source ];
+      serviceConfig = {
+        ExecStart = "${pkg}/bin/nix-gocacheprog -mode server";
+        CacheDirectory = "nix-gocacheprog";
+        DynamicUser = "true";
+      };
     };
   };
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// derivation attr (so also env var) that makes the module proxy serve only
+// from the cache, never asking upstreams.
+const offlineEnv = "nixGocacheprogOffline"
+
+// how many times to try recording a version before giving up
+const recordVersionTries = 5
+
+// serveOffline answers a proxy request from the cache only. Lists are made
+// from the versions we have cached, since a cached list from upstream would
+// include versions we can't serve.
+func (h *proxyHandler) serveOffline(w http.ResponseWriter, path string, actionIDs ...[]byte) {
+	mod, kind, version, err := parseProxyPath(path)
+	if err != nil {
+		http.Error(w, "offline: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	versions := h.offlineVersions(mod)
+
+	if kind == "list" {
+		if len(versions) == 0 {
+			h.misses.Add(1)
+			http.Error(w, fmt.Sprintf("offline: no versions of %s are cached", mod), http.StatusNotFound)
+			return
+		}
+		h.hits.Add(1)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, strings.Join(versions, "\n"))
+		return
+	}
+
+	if ent, err := h.lookup(forever, actionIDs...); err == nil {
+		h.hits.Add(1)
+		h.writeCached(w, ent)
+		ent.f.Close()
+		return
+	}
+	h.misses.Add(1)
+
+	what := mod + "@" + kind
+	if version != "" {
+		what = mod + "@" + version + " ." + kind
+	}
+	msg := fmt.Sprintf("offline: %s is not cached", what)
+	if len(versions) > 0 {
+		msg += fmt.Sprintf(" (cached versions: %s)", strings.Join(versions, " "))
+	} else {
+		msg += fmt.Sprintf(" (no versions of %s are cached)", mod)
+	}
+	log.Println(msg)
+	http.Error(w, msg, http.StatusNotFound)
+}
+
+func versionsActionID(mod string) []byte {
+	hsh := sha256.New()
+	fmt.Fprintf(hsh, "gomodproxy versions v1\n")
+	fmt.Fprintf(hsh, "module=%s\n", mod)
+	return hsh.Sum(nil)[:proxyCacheKeyBytes]
+}
+
+// offlineVersions returns the versions of mod that we can serve. The record
+// from recordVersion can miss some if builds raced to update it, so versions
+// from a cached upstream list count too, as long as their zip is cached.
+func (h *proxyHandler) offlineVersions(mod string) []string {
+	candidates := h.cachedVersions(mod)
+	if ent, err := h.lookup(forever, moduleActionID(mod, "list", ""), pathActionID(proxyPath(mod, "list", ""))); err == nil {
+		b, _ := io.ReadAll(ent.f)
+		ent.f.Close()
+		candidates = append(candidates, strings.Fields(string(b))...)
+	}
+	semver.Sort(candidates)
+	candidates = slices.Compact(candidates)
+
+	var versions []string
+	for _, v := range candidates {
+		if ent, err := h.lookup(forever, moduleActionID(mod, "zip", v), pathActionID(proxyPath(mod, "zip", v))); err == nil {
+			ent.f.Close()
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// proxyPath is the opposite of parseProxyPath.
+func proxyPath(mod, kind, version string) string {
+	escMod, err := module.EscapePath(mod)
+	if err != nil {
+		return ""
+	}
+	switch kind {
+	case "list":
+		return "/" + escMod + "/@v/list"
+	case "latest":
+		return "/" + escMod + "/@latest"
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return ""
+	}
+	return "/" + escMod + "/@v/" + escVersion + "." + kind
+}
+
+// cachedVersions returns the versions of mod that recordVersion recorded.
+func (h *proxyHandler) cachedVersions(mod string) []string {
+	res, err := h.cc.get(versionsActionID(mod))
+	if err != nil || res.Err != "" || res.Miss || res.DiskPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(res.DiskPath)
+	if err != nil {
+		return nil
+	}
+	versions := strings.Fields(string(b))
+	semver.Sort(versions)
+	return versions
+}
+
+// recordVersion adds version to the cached versions of mod, once its zip is
+// cached. Proxies for other builds may be updating the same record, so it
+// merges with what's there and checks that our version stuck.
+func (h *proxyHandler) recordVersion(mod, version string) error {
+	h.versionsLock.Lock()
+	defer h.versionsLock.Unlock()
+
+	for try := 0; try < recordVersionTries; try++ {
+		versions := h.cachedVersions(mod)
+		if slices.Contains(versions, version) {
+			return nil
+		}
+		versions = append(versions, version)
+		semver.Sort(versions)
+		data := strings.Join(versions, "\n") + "\n"
+		objectID := sha256.Sum256([]byte(data))
+		res, err := h.cc.put(versionsActionID(mod), objectID[:proxyCacheKeyBytes], int64(len(data)), strings.NewReader(data))
+		if err != nil {
+			return err
+		} else if res.Err != "" {
+			return errors.New(res.Err)
+		}
+	}
+	return fmt.Errorf("recording %s@%s: lost too many races", mod, version)
+}
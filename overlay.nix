@@ -19,19 +19,42 @@
 
       export GOCACHEPROG=$client
       echo "Setting GOCACHEPROG to $GOCACHEPROG"
+      # print a cache summary at the end of each go command
+      export nixGocacheprogVerbose=''${nixGocacheprogVerbose-1}
 
       # default value from https://go.dev/ref/mod
       case "''${GOPROXY:=https://proxy.golang.org,direct}" in
         off|file*) # main build, do nothing
           ;;
         *) # module build
-          $client -mode goproxy &
-          export GOPROXY="http://localhost${const.ProxyListen},$GOPROXY"
+          # the proxy picks a port and writes it here once it's listening
+          local addrFile=$NIX_BUILD_TOP/.nix-gocacheprog-proxy
+          rm -f $addrFile
+          $client -mode goproxy $addrFile &
+          _nixGocacheprogProxyPid=$!
+          while [[ ! -s $addrFile ]]; do
+            if ! kill -0 $_nixGocacheprogProxyPid 2>/dev/null; then
+              echo "nix-gocacheprog module proxy failed to start"
+              unset _nixGocacheprogProxyPid
+              return
+            fi
+            sleep 0.05
+          done
+          postBuildHooks+=(_nixGocacheprogStopProxy)
+          export GOPROXY="http://$(<$addrFile),$GOPROXY"
           echo "Using nix-gocacheprog module proxy"
           echo "Setting GOPROXY to $GOPROXY"
           ;;
       esac
     }
+    _nixGocacheprogStopProxy() {
+      # the proxy prints its summary when stopped
+      # it may have exited already, and exits nonzero on SIGTERM, so don't
+      # fail the build either way
+      kill "$_nixGocacheprogProxyPid" 2>/dev/null || true
+      wait "$_nixGocacheprogProxyPid" 2>/dev/null || true
+      unset _nixGocacheprogProxyPid
+    }
     postConfigureHooks+=(_nixGocacheprogHook)
   '');
 
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// default range for nix's auto-allocate-uids (start-id and id-count)
+const (
+	autoAllocateStart = 872415232
+	autoAllocateCount = 1048576
+)
+
+// peerPolicy decides which peer uids may use each phase of the protocol.
+type peerPolicy struct {
+	hookUIDs   []uint32
+	buildGroup string
+	buildRange [][2]uint32
+
+	lock     sync.Mutex
+	isBuild  map[uint32]bool // cached group lookups
+	groupGid string
+}
+
+func newPeerPolicy(cfg *Config) *peerPolicy {
+	pp := &peerPolicy{
+		hookUIDs:   cfg.HookUIDs,
+		buildGroup: cfg.BuildGroup,
+		buildRange: cfg.BuildUIDRanges,
+		isBuild:    make(map[uint32]bool),
+	}
+	if pp.buildGroup == "" {
+		pp.buildGroup = "nixbld"
+	}
+	if pp.buildRange == nil {
+		pp.buildRange = [][2]uint32{{autoAllocateStart, autoAllocateStart + autoAllocateCount - 1}}
+	}
+	if g, err := user.LookupGroup(pp.buildGroup); err == nil {
+		pp.groupGid = g.Gid
+	}
+	return pp
+}
+
+// check returns an error if uid may not use phase.
+func (pp *peerPolicy) check(uid uint32, phase string) error {
+	switch phase {
+	case PhaseHook, PhaseDone, PhaseList, PhaseModules:
+		// the hook side and admin tools
+		if uid == 0 || slices.Contains(pp.hookUIDs, uid) {
+			return nil
+		}
+	case PhaseBuild:
+		if pp.allowBuild(uid) {
+			return nil
+		}
+	default:
+		return nil // rejected later anyway
+	}
+	return fmt.Errorf("uid %d not allowed to use phase %q", uid, phase)
+}
+
+func (pp *peerPolicy) allowBuild(uid uint32) bool {
+	for _, r := range pp.buildRange {
+		if uid >= r[0] && uid <= r[1] {
+			return true
+		}
+	}
+	if pp.groupGid == "" {
+		return false
+	}
+
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if ok, cached := pp.isBuild[uid]; cached {
+		return ok
+	}
+	ok := false
+	if u, err := user.LookupId(strconv.Itoa(int(uid))); err == nil {
+		if u.Gid == pp.groupGid {
+			ok = true
+		} else if gids, err := u.GroupIds(); err == nil {
+			ok = slices.Contains(gids, pp.groupGid)
+		}
+	}
+	pp.isBuild[uid] = ok
+	return ok
+}
+
+// peerUID returns the uid of the process on the other end of a unix socket.
+func peerUID(conn net.Conn) (uint32, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, errors.New("not a unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	} else if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
@@ -2,26 +2,47 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
+	"cmp"
+	"context"
 	"crypto/sha256"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"maps"
+	"math"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
-// TODO: this is kind of gross but works ok for now
-const headerPrefixSize = 4096
 const proxyCacheKeyBytes = 24
 const proxyDebug = false
 
+// derivation attr (so also env var) with how long to cache lists and other
+// proxy responses that change, e.g. "10m". They're used for longer than that
+// if upstreams fail.
+const proxyTTLEnv = "nixGocacheprogProxyTTL"
+
+const defaultProxyTTL = 10 * time.Minute
+const forever = time.Duration(math.MaxInt64)
+
+// derivation attr (so also env var) with a GOPROXY-style list to use for
+// modules matching GONOPROXY or GOPRIVATE, instead of "direct".
+const privateProxyEnv = "nixGocacheprogPrivateProxy"
+
 var skipReturnHeaders = map[string]bool{
 	"Alt-Svc":                   true,
 	"Content-Transfer-Encoding": true,
@@ -29,8 +50,32 @@ var skipReturnHeaders = map[string]bool{
 }
 
 type proxyHandler struct {
-	cc        *CacheClient
-	upstreams []url.URL
+	cc      *CacheClient
+	proxies []proxySpec
+	// used instead of proxies for modules matching noProxy
+	private []proxySpec
+	// GONOPROXY and GONOSUMDB patterns, which both default to GOPRIVATE
+	noProxy string
+	noSumDB string
+	// how long to cache responses that change
+	ttl time.Duration
+	// what to check modules against before caching them
+	goSum map[string]string
+	sumdb *sumDB
+	// only serve from the cache
+	offline bool
+
+	versionsLock sync.Mutex
+
+	// fetches in progress, by action id
+	flightsLock sync.Mutex
+	flights     map[string]chan struct{}
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	fetches    atomic.Int64
+	hitBytes   atomic.Int64
+	fetchBytes atomic.Int64
 }
 
 func proxyMain() {
@@ -38,192 +83,464 @@ func proxyMain() {
 	log.SetPrefix("nix-gocacheprog mod proxy:")
 
 	// the hook ensures GOPROXY is set here. this GOPROXY does not include ourself.
-	var upstreams []url.URL
-	for _, up := range strings.Split(os.Getenv("GOPROXY"), ",") {
-		if u, err := url.Parse(up); err == nil && u.Scheme == "http" || u.Scheme == "https" {
-			upstreams = append(upstreams, *u)
-		}
+	proxies, err := parseGoproxy(os.Getenv("GOPROXY"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// private modules go direct unless configured otherwise
+	private, err := parseGoproxy(cmp.Or(os.Getenv(privateProxyEnv), "direct"))
+	if err != nil {
+		log.Fatalln(privateProxyEnv+":", err)
 	}
-	uc := initClient()
 	h := &proxyHandler{
-		cc:        NewCacheClient(uc, uc),
-		upstreams: upstreams,
+		cc:      cacheClient(),
+		proxies: proxies,
+		private: private,
+		noProxy: cmp.Or(os.Getenv("GONOPROXY"), os.Getenv("GOPRIVATE")),
+		noSumDB: cmp.Or(os.Getenv("GONOSUMDB"), os.Getenv("GOPRIVATE")),
+	}
+	if v := os.Getenv(offlineEnv); v != "" && v != "0" && v != "false" {
+		log.Println("offline, serving only from the cache")
+		h.offline = true
+	}
+	h.ttl = defaultProxyTTL
+	if v := os.Getenv(proxyTTLEnv); v != "" {
+		if h.ttl, err = time.ParseDuration(v); err != nil {
+			log.Fatalln(proxyTTLEnv+":", err)
+		}
+	}
+	if h.goSum, err = readGoSum(strings.Fields(os.Getenv(goSumEnv))); err != nil {
+		log.Fatalln(goSumEnv+":", err)
+	}
+	if h.sumdb, err = newSumDB(os.Getenv("GOSUMDB"), h.noSumDB, h.cc); err != nil {
+		log.Fatalln(err)
+	} else if h.sumdb != nil {
+		h.sumdb.offline = h.offline
 	}
-	err := http.ListenAndServe(ProxyListen, h)
+	go func() {
+		// the setup hook stops us when the build is done
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		<-sigs
+		h.printStats(os.Stderr, verbosity())
+		h.cleanup()
+		os.Exit(0)
+	}()
+
+	l, err := net.Listen("tcp", ProxyListen)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	// tell the setup hook where we are. we're already listening, so we're
+	// ready as soon as it sees this.
+	if err := writeProxyAddr(flag.Arg(0), l.Addr().String()); err != nil {
+		log.Fatalln(err)
+	}
+	err = http.Serve(l, h)
+	if err != nil {
+		h.cleanup()
+		log.Fatalln(err)
+	}
+}
+
+// writeProxyAddr writes addr to file atomically, or to stdout if file is empty.
+func writeProxyAddr(file, addr string) error {
+	if file == "" {
+		_, err := fmt.Println(addr)
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(addr+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
 }
 
 func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	path := req.URL.Path
 
-	var actionID []byte
-	// only .mod and .zip paths are immutable and should be cached, others are passed through
-	// wihtout caching.
-	if strings.HasSuffix(path, ".mod") || strings.HasSuffix(path, ".zip") {
-		// make cache key
-		hsh := sha256.New()
-		fmt.Fprintf(hsh, "gomodproxy v1\n")
-		fmt.Fprintf(hsh, "path=%s\n", path)
-		fmt.Fprintf(hsh, "headerPrefixSize=%d\n", headerPrefixSize)
-		actionID = hsh.Sum(nil)[:proxyCacheKeyBytes]
+	if rest, ok := strings.CutPrefix(path, "/sumdb/"); ok && h.sumdb != nil {
+		h.sumdb.serveHTTP(w, rest)
+		return
+	}
+
+	// only module paths are cached, others are passed through without caching
+	var actionID, oldActionID []byte
+	mod, kind, version, err := parseProxyPath(path)
+	ttl := h.cacheTTL(kind, version)
+	if err == nil {
+		actionID = moduleActionID(mod, kind, version)
+		oldActionID = pathActionID(path)
+	}
+
+	if h.offline {
+		h.serveOffline(w, path, actionID, oldActionID)
+		return
 	}
 
 	// check if we can get it from cache
+	var stale *cacheEntry
 	if actionID != nil {
-		err := h.getAndWrite(w, actionID)
-		if err == nil {
+		ent, err := h.lookup(ttl, actionID, oldActionID)
+		if ent == nil || ent.expired {
+			// if someone else is already fetching this, wait for them and
+			// look again. keep what we have in case they didn't get anything.
+			if leave, ferr := h.startFlight(req.Context(), actionID); ferr != nil {
+				// the client went away while we waited
+				if ent != nil {
+					ent.f.Close()
+				}
+				return
+			} else if leave != nil {
+				defer leave()
+			} else if again, _ := h.lookup(ttl, actionID, oldActionID); again != nil {
+				if ent != nil {
+					ent.f.Close()
+				}
+				ent, err = again, nil
+			}
+		}
+		if ent != nil && !ent.expired {
+			h.hits.Add(1)
 			if proxyDebug {
 				log.Printf("hit %s", path)
 			}
+			h.writeCached(w, ent)
+			ent.f.Close()
 			return
+		} else if ent != nil {
+			// too old, but better than nothing if upstreams fail
+			stale = ent
+			defer stale.f.Close()
+			err = errors.New("expired")
 		}
+		h.misses.Add(1)
 		if proxyDebug {
 			log.Printf("miss %s (%s)", path, err)
 		}
 	}
 
 	// nope, try upstreams
-	for i, up := range h.upstreams {
-		islast := i == len(h.upstreams)-1
+	res, err := h.fetch(req, path)
+	if stale != nil && (err != nil || res.StatusCode != http.StatusOK && !notFound(res.StatusCode)) {
+		if err == nil {
+			res.Body.Close()
+			err = errors.New(res.Status)
+		}
+		log.Printf("upstream error %s, serving stale %s", err, path)
+		h.writeCached(w, stale)
+		return
+	} else if err != nil {
+		log.Printf("upstream error %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		log.Printf("upstream status %s", res.Status)
+		// pass through full response
+		copyHeadersReturn(w, res)
+		io.Copy(w, res.Body)
+		return
+	}
+
+	// we got an ok, let's use this
 
-		try := up.JoinPath(path).String()
+	h.fetches.Add(1)
+	if actionID == nil {
+		if res.ContentLength > 0 {
+			h.fetchBytes.Add(res.ContentLength)
+		}
+		copyHeadersReturn(w, res)
 		if proxyDebug {
-			log.Printf("querying %s", try)
+			log.Printf("passthrough %s", path)
 		}
-		outReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, try, nil)
-		if err != nil {
-			log.Fatal(err)
+		io.Copy(w, res.Body)
+		return
+	}
+
+	// spool it, so we can cache it even without a Content-Length, and use
+	// its hash as the object id. modules are checked before anyone sees them,
+	// everything else streams through to the client as we go.
+	check := kind == "mod" || kind == "zip"
+	var body io.Reader = res.Body
+	var out io.Writer = w
+	if !check {
+		copyHeadersReturn(w, res)
+		body = io.TeeReader(res.Body, w)
+		out = io.Discard
+	}
+	f, size, bodySum, err := spool(body)
+	if err != nil {
+		log.Println("spool error", err)
+		if check {
+			http.Error(w, err.Error(), http.StatusBadGateway)
 		}
-		res, err := http.DefaultClient.Do(outReq)
-		if err != nil {
-			if islast {
-				log.Printf("http error %s on last upstream", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			} else {
-				log.Printf("http error %s, trying next", err)
-				continue
-			}
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h.fetchBytes.Add(size)
+	res.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	meta := entryMeta{Module: mod, Version: version, Kind: kind}
+
+	if check {
+		if err := h.verifyModule(mod, kind, version, f); errors.Is(err, errChecksumMismatch) {
+			log.Println("SECURITY ERROR", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		} else if err != nil {
+			// the go command checks for itself too, so pass it on, but don't
+			// cache something we couldn't check
+			log.Printf("not caching %s: %s", path, err)
+			copyHeadersReturn(w, res)
+			io.Copy(w, f)
+			return
 		}
+		copyHeadersReturn(w, res)
+	}
+	if err, tryCopyOnError := h.putAndWrite(out, meta, res.Header, f, size, bodySum, actionID); err != nil {
+		log.Println("put error", err)
+		if tryCopyOnError && check {
+			io.Copy(w, f)
+		}
+		return
+	}
 
-		if res.StatusCode != http.StatusOK {
-			if islast {
-				log.Printf("http status %s on last upstream", res.Status)
-				// pass through full response
-				defer res.Body.Close()
-				copyHeadersReturn(w, res)
-				io.Copy(w, res.Body)
-				return
-			} else {
-				log.Printf("http status %s, trying next", res.Status)
-				res.Body.Close()
-				continue
-			}
+	// remember what we have, for offline lists. without the zip we can't
+	// serve a version, so that's what counts.
+	if kind == "zip" {
+		if err := h.recordVersion(mod, version); err != nil {
+			log.Println("put error", err)
 		}
+	}
+}
 
-		// we got an ok, let's use this
+// spool copies r to a temp file and returns it rewound, with its size and
+// sha256.
+func spool(r io.Reader) (*os.File, int64, []byte, error) {
+	f, err := os.CreateTemp("", "nix-gocacheprog-proxy-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	hsh := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hsh), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, nil, err
+	}
+	return f, n, hsh.Sum(nil), nil
+}
 
-		defer res.Body.Close()
-		copyHeadersReturn(w, res)
-		if actionID == nil {
-			if proxyDebug {
-				log.Printf("passthrough %s", path)
-			}
-			io.Copy(w, res.Body)
-			return
+// fetch tries the GOPROXY entries (or the private ones) in order, with the
+// same fallback rules as the go command: after a ",", only not found (404 or
+// 410) falls through to the next entry; after a "|", any error does. It
+// returns the first ok response, or the response or error from the last entry
+// it tried.
+func (h *proxyHandler) fetch(req *http.Request, path string) (*http.Response, error) {
+	proxies := h.proxies
+	if mod, _, _, err := parseProxyPath(path); err == nil && module.MatchPrefixPatterns(h.noProxy, mod) {
+		// never ask public mirrors about private modules
+		proxies = h.private
+	}
+	if len(proxies) == 0 {
+		return textResponse(http.StatusNotFound, "no upstreams"), nil
+	}
+	for i, p := range proxies {
+		islast := i == len(proxies)-1
+
+		if proxyDebug {
+			log.Printf("querying %s for %s", p.up, path)
+		}
+		res, err := p.up.fetch(req.Context(), path)
+		if err == nil && res.StatusCode == http.StatusOK {
+			return res, nil
+		} else if islast {
+			return res, err
 		}
 
-		if err, tryCopyOnError := h.putAndWrite(w, req, res, actionID); err != nil {
-			log.Println("put error", err)
-			if tryCopyOnError {
-				io.Copy(w, res.Body)
-			}
-			return
+		if !(err == nil && notFound(res.StatusCode)) && !p.fallBackOnError {
+			return res, err
+		}
+		if err != nil {
+			log.Printf("error %s from %s, trying next", err, p.up)
+		} else {
+			log.Printf("status %s from %s, trying next", res.Status, p.up)
+			res.Body.Close()
 		}
+	}
+	panic("unreachable")
+}
 
-		return
+// lookup gets the first cache entry found for actionIDs and checks whether
+// it's older than ttl.
+func (h *proxyHandler) lookup(ttl time.Duration, actionIDs ...[]byte) (ent *cacheEntry, err error) {
+	for _, actionID := range actionIDs {
+		if ent, err = h.getCached(actionID); err == nil {
+			ent.expired = ttl != forever && time.Since(ent.fetched) >= ttl
+			return ent, nil
+		}
+	}
+	return nil, err
+}
+
+// moduleActionID is the cache key for a proxy file, from the decoded module
+// path and version, so it doesn't depend on how the path was written.
+func moduleActionID(mod, kind, version string) []byte {
+	hsh := sha256.New()
+	fmt.Fprintf(hsh, "gomodproxy v2\n")
+	fmt.Fprintf(hsh, "module=%s\n", mod)
+	fmt.Fprintf(hsh, "kind=%s\n", kind)
+	fmt.Fprintf(hsh, "version=%s\n", version)
+	return hsh.Sum(nil)[:proxyCacheKeyBytes]
+}
+
+// pathActionID is the old cache key, from the raw URL path. We still look
+// for entries under it.
+func pathActionID(path string) []byte {
+	hsh := sha256.New()
+	fmt.Fprintf(hsh, "gomodproxy v1\n")
+	fmt.Fprintf(hsh, "path=%s\n", path)
+	fmt.Fprintf(hsh, "headerPrefixSize=%d\n", legacyHeaderSize)
+	return hsh.Sum(nil)[:proxyCacheKeyBytes]
+}
+
+// startFlight marks actionID as being fetched and returns a func to call when
+// done. If it's already being fetched, it waits for that and returns nil, or
+// an error if ctx is done first.
+func (h *proxyHandler) startFlight(ctx context.Context, actionID []byte) (func(), error) {
+	key := string(actionID)
+	h.flightsLock.Lock()
+	if done, ok := h.flights[key]; ok {
+		h.flightsLock.Unlock()
+		select {
+		case <-done:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+	if h.flights == nil {
+		h.flights = make(map[string]chan struct{})
+	}
+	done := make(chan struct{})
+	h.flights[key] = done
+	h.flightsLock.Unlock()
 
-	http.Error(w, "no upstreams", http.StatusNotFound)
+	return func() {
+		h.flightsLock.Lock()
+		delete(h.flights, key)
+		h.flightsLock.Unlock()
+		close(done)
+	}, nil
 }
 
-func (h *proxyHandler) getAndWrite(w http.ResponseWriter, actionID []byte) error {
+func (h *proxyHandler) getCached(actionID []byte) (*cacheEntry, error) {
 	cacheRes, err := h.cc.get(actionID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if cacheRes.Err != "" {
-		return errors.New(cacheRes.Err)
+		return nil, errors.New(cacheRes.Err)
 	} else if cacheRes.Miss {
-		return errors.New("cache miss")
+		return nil, errors.New("cache miss")
 	} else if cacheRes.DiskPath == "" {
-		return errors.New("missing disk path")
+		return nil, errors.New("missing disk path")
 	}
 	f, err := os.Open(cacheRes.DiskPath)
 	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	hbuf := make([]byte, headerPrefixSize)
-	if _, err := io.ReadFull(f, hbuf); err != nil {
-		return err
+		return nil, err
 	}
-	var headers http.Header
-	if err := json.Unmarshal(hbuf, &headers); err != nil {
-		return err
+	ent, err := readCacheEntry(f, cacheRes.Size)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
-
-	// verify matching sizes
-	if fi, err := f.Stat(); err != nil {
-		return err
-	} else if cacheRes.Size != fi.Size() {
-		return fmt.Errorf("mismatched cache size and disk size: %d != %d", cacheRes.Size, fi.Size())
-	} else if cl, err := strconv.Atoi(headers.Get("Content-Length")); err != nil {
-		// this should be there, but if not fill it in
-		headers.Set("Content-Length", strconv.Itoa(int(cacheRes.Size)))
-	} else if cl != int(cacheRes.Size)-headerPrefixSize {
-		return fmt.Errorf("cache had wrong Content-Length header: %d != %d", cl, cacheRes.Size-headerPrefixSize)
+	if ent.fetched.IsZero() && cacheRes.TimeNanos != 0 {
+		// rewritten on every put, even if the content is the same
+		ent.fetched = time.Unix(0, cacheRes.TimeNanos)
 	}
+	return ent, nil
+}
 
-	// all good, start writing response
-	maps.Copy(w.Header(), headers)
+func (h *proxyHandler) writeCached(w http.ResponseWriter, ent *cacheEntry) {
+	maps.Copy(w.Header(), ent.header)
 	w.WriteHeader(http.StatusOK)
-	if _, err := io.Copy(w, f); err != nil {
+	n, err := io.Copy(w, ent.f)
+	if err != nil {
 		log.Println("copy error from cache", err)
 	}
-	return nil
+	h.hitBytes.Add(n)
 }
 
-func (h *proxyHandler) putAndWrite(w http.ResponseWriter, req *http.Request, res *http.Response, actionID []byte) (error, bool) {
-	if res.ContentLength < 0 {
-		return errors.New("can't cache without ContentLength"), true
+// cacheTTL returns how long a proxy file can be served from the cache without
+// asking upstream. .mod and .zip files, and .info for exact versions, never
+// change. Lists, latest, and .info for queries like branches are cached for
+// h.ttl.
+func (h *proxyHandler) cacheTTL(kind, version string) time.Duration {
+	switch kind {
+	case "mod", "zip":
+		return forever
+	case "info":
+		if semver.IsValid(version) && version == module.CanonicalVersion(version) {
+			return forever
+		}
 	}
+	return h.ttl
+}
 
-	var hbuf bytes.Buffer
-	hbuf.Grow(headerPrefixSize)
-	if err := json.NewEncoder(&hbuf).Encode(res.Header); err != nil {
-		return err, true
-	} else if hbuf.Len() > headerPrefixSize {
-		return errors.New("headers are too big"), true
+// cleanup removes anything the upstreams keep on disk.
+func (h *proxyHandler) cleanup() {
+	for _, p := range slices.Concat(h.proxies, h.private) {
+		if c, ok := p.up.(interface{ cleanup() }); ok {
+			c.cleanup()
+		}
 	}
-	for hbuf.Len() < headerPrefixSize {
-		hbuf.WriteByte('\n')
+}
+
+func notFound(code int) bool {
+	return code == http.StatusNotFound || code == http.StatusGone
+}
+
+func (h *proxyHandler) printStats(w io.Writer, verbose int) {
+	hits, misses := h.hits.Load(), h.misses.Load()
+	if verbose <= 0 || hits+misses == 0 {
+		return
+	}
+	fmt.Fprintf(w, "nix-gocacheprog mod proxy: %d/%d hits (%s), %d fetches (%s)\n",
+		hits, hits+misses, formatBytes(h.hitBytes.Load()), h.fetches.Load(), formatBytes(h.fetchBytes.Load()))
+}
+
+// putAndWrite stores a spooled response under actionID, copying the body to w
+// as it goes. Only .mod and .zip need that, since they're held back until
+// they're checked; everything else already went to the client while it was
+// spooled, and w is io.Discard. On error, the bool says whether nothing was
+// written to w yet, so the caller can still send the body.
+func (h *proxyHandler) putAndWrite(w io.Writer, meta entryMeta, header http.Header, body io.Reader, size int64, bodySum, actionID []byte) (error, bool) {
+	prefix, err := encodeEntryPrefix(meta, header)
+	if err != nil {
+		return err, true
 	}
 
 	// if we got this far, the client (Go) should accept the response, any errors from here are
 	// just our problem.
 
-	// we want to stream through but we need an object id first, so we can't use a hash. use a
-	// random id.
-	objectID := make([]byte, proxyCacheKeyBytes)
-	rand.Read(objectID)
+	// the id comes from the content only, so refetching something that
+	// hasn't changed reuses the same object. that's why the entry doesn't say
+	// when it was fetched: the object's mtime does.
+	hsh := sha256.New()
+	hsh.Write(prefix)
+	hsh.Write(bodySum)
+	objectID := hsh.Sum(nil)[:proxyCacheKeyBytes]
 
-	concat := io.MultiReader(&hbuf, io.TeeReader(res.Body, w))
-	if cacheRes, err := h.cc.put(actionID, objectID, int64(hbuf.Len())+res.ContentLength, concat); err != nil {
+	concat := io.MultiReader(bytes.NewReader(prefix), io.TeeReader(body, w))
+	if cacheRes, err := h.cc.put(actionID, objectID, int64(len(prefix))+size, concat); err != nil {
 		return err, false
 	} else if cacheRes.Err != "" {
 		return errors.New(cacheRes.Err), false
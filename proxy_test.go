@@ -0,0 +1,296 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCacheClient returns a CacheClient backed by a DiskCache in a temp dir.
+// Like a build's, it gets outputs through hardlinks in a build dir.
+func testCacheClient(t *testing.T) (*CacheClient, *DiskCache) {
+	dc := &DiskCache{Dir: t.TempDir()}
+	sandbox := t.TempDir()
+	old := SandboxCacheDir
+	SandboxCacheDir = sandbox
+	t.Cleanup(func() { SandboxCacheDir = old })
+	const buildID = BuildIDPrefix + "test"
+	buildDir := filepath.Join(sandbox, buildID)
+	if err := os.Mkdir(buildDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	p := &Process{In: reqR, Out: resW, Get: dc.Get, Put: dc.Put, buildID: buildID, buildDir: buildDir}
+	go p.RunLocal()
+	t.Cleanup(func() { reqW.Close() })
+	return NewCacheClient(resR, reqW), dc
+}
+
+// testUpstream serves files from a map, and counts requests by path.
+type testUpstream struct {
+	*httptest.Server
+	lock  sync.Mutex
+	files map[string]string
+	reqs  map[string]int
+}
+
+func newTestUpstream(t *testing.T, files map[string]string) *testUpstream {
+	u := &testUpstream{files: files, reqs: make(map[string]int)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.lock.Lock()
+		u.reqs[r.URL.Path]++
+		body, ok := u.files[r.URL.Path]
+		u.lock.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *testUpstream) count(path string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.reqs[path]
+}
+
+// testZip makes a module zip with one file.
+func testZip(t *testing.T, prefix string) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if w, err := zw.Create(prefix + "/a.go"); err != nil {
+		t.Fatal(err)
+	} else {
+		io.WriteString(w, "package a\n")
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func testProxy(t *testing.T, cc *CacheClient, upstream string) *proxyHandler {
+	proxies, err := parseGoproxy(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &proxyHandler{cc: cc, proxies: proxies, ttl: time.Hour}
+}
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestOfflineList(t *testing.T) {
+	up := newTestUpstream(t, map[string]string{
+		"/x.com/a/@v/list":        "v1.0.0\nv1.1.0\n",
+		"/x.com/a/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"/x.com/a/@v/v1.0.0.mod":  "module x.com/a\n",
+		"/x.com/a/@v/v1.0.0.zip":  testZip(t, "x.com/a@v1.0.0"),
+		"/x.com/a/@v/v1.1.0.info": `{"Version":"v1.1.0"}`,
+		"/x.com/a/@v/v1.1.0.mod":  "module x.com/a\n",
+	})
+	cc, _ := testCacheClient(t)
+	h := testProxy(t, cc, up.URL)
+	for p := range up.files {
+		if code, body := get(t, h, p); code != http.StatusOK {
+			t.Fatalf("%s: %d %s", p, code, body)
+		}
+	}
+
+	h.offline = true
+	// v1.1.0 has no zip, so we can't serve it
+	if code, body := get(t, h, "/x.com/a/@v/list"); code != http.StatusOK || body != "v1.0.0\n" {
+		t.Errorf("list: %d %q", code, body)
+	}
+
+	// another build's proxy replaced the record without our version, but
+	// the cached upstream list still has it
+	data := "v0.9.0\n"
+	if _, err := cc.put(versionsActionID("x.com/a"), []byte("lost-race-object-id-0123"), int64(len(data)), strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get(t, h, "/x.com/a/@v/list"); code != http.StatusOK || body != "v1.0.0\n" {
+		t.Errorf("list after lost record: %d %q", code, body)
+	}
+
+	if code, body := get(t, h, "/x.com/a/@v/v1.1.0.zip"); code != http.StatusNotFound || !strings.Contains(body, "cached versions: v1.0.0") {
+		t.Errorf("v1.1.0.zip: %d %q", code, body)
+	}
+}
+
+func TestFlightWaitersLeave(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var reqs sync.Map
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := reqs.LoadOrStore(r.URL.Path, new(int))
+		*n.(*int)++
+		started <- struct{}{}
+		<-release
+		io.WriteString(w, "v1.0.0\n")
+	}))
+	defer up.Close()
+	cc, _ := testCacheClient(t)
+	h := testProxy(t, cc, up.URL)
+
+	const path = "/x.com/a/@v/list"
+	leader := make(chan string)
+	go func() {
+		_, body := get(t, h, path)
+		leader <- body
+	}()
+	<-started
+
+	// a client that goes away while waiting gets let go
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx))
+		close(gone)
+	}()
+	waiter := make(chan string)
+	go func() {
+		_, body := get(t, h, path)
+		waiter <- body
+	}()
+	cancel()
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter didn't leave when its client went away")
+	}
+
+	close(release)
+	if body := <-leader; body != "v1.0.0\n" {
+		t.Errorf("leader got %q", body)
+	}
+	if body := <-waiter; body != "v1.0.0\n" {
+		t.Errorf("waiter got %q", body)
+	}
+	if n, _ := reqs.Load(path); *n.(*int) != 1 {
+		t.Errorf("%d upstream requests, want 1", *n.(*int))
+	}
+}
+
+func TestRefetchSharesObject(t *testing.T) {
+	up := newTestUpstream(t, map[string]string{"/x.com/a/@v/list": "v1.0.0\n"})
+	cc, dc := testCacheClient(t)
+	h := testProxy(t, cc, up.URL)
+	h.ttl = 200 * time.Millisecond
+
+	const path = "/x.com/a/@v/list"
+	for i, wait := range []time.Duration{0, 250 * time.Millisecond, 0} {
+		time.Sleep(wait)
+		if code, body := get(t, h, path); code != http.StatusOK || body != "v1.0.0\n" {
+			t.Fatalf("%d: %d %q", i, code, body)
+		}
+	}
+	// the refetch replaced the object, but the build still has the old one
+	// linked. that's fine since they're the same, and the last get is fresh.
+	if n := up.count(path); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+	objects, _ := filepath.Glob(filepath.Join(dc.Dir, "o-*"))
+	if len(objects) != 1 {
+		t.Errorf("%d objects for the same content, want 1", len(objects))
+	}
+}
+
+// putLegacyEntry caches body for path the way we did before entries had a
+// format version and before keys were by module.
+func putLegacyEntry(t *testing.T, cc *CacheClient, path, body string, fetched time.Time) {
+	t.Helper()
+	hj, _ := json.Marshal(http.Header{
+		"Content-Length":    {strconv.Itoa(len(body))},
+		legacyFetchedHeader: {fetched.UTC().Format(time.RFC3339Nano)},
+	})
+	data := string(hj) + strings.Repeat("\n", legacyHeaderSize-len(hj)) + body
+	objectID := sha256.Sum256([]byte(data))
+	if _, err := cc.put(pathActionID(path), objectID[:proxyCacheKeyBytes], int64(len(data)), strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyEntry(t *testing.T) {
+	up := newTestUpstream(t, map[string]string{"/x.com/a/@v/list": "v2.0.0\n"})
+	cc, _ := testCacheClient(t)
+	h := testProxy(t, cc, up.URL)
+
+	// an entry in the old format, under the old key, fetched just now
+	const path = "/x.com/a/@v/list"
+	body := "v1.0.0\n"
+	putLegacyEntry(t, cc, path, body, time.Now())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK || w.Body.String() != body {
+		t.Errorf("got %d %q, want the cached entry", w.Code, w.Body.String())
+	}
+	if v := w.Header().Get(legacyFetchedHeader); v != "" {
+		t.Errorf("sent %s: %s", legacyFetchedHeader, v)
+	}
+	if n := up.count(path); n != 0 {
+		t.Errorf("%d upstream requests, want 0", n)
+	}
+}
+
+func TestWaiterKeepsStale(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var first sync.Once
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first.Do(func() {
+			close(started)
+			<-release
+		})
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer up.Close()
+	cc, _ := testCacheClient(t)
+	h := testProxy(t, cc, up.URL)
+
+	// an expired entry under the old key
+	const path = "/x.com/a/@v/list"
+	body := "v1.0.0\n"
+	putLegacyEntry(t, cc, path, body, time.Now().Add(-2*h.ttl))
+
+	results := make(chan string, 2)
+	go func() {
+		code, body := get(t, h, path)
+		results <- strconv.Itoa(code) + " " + body
+	}()
+	<-started
+	go func() {
+		code, body := get(t, h, path)
+		results <- strconv.Itoa(code) + " " + body
+	}()
+	// give the second request time to start waiting on the first
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if got := <-results; got != "200 "+body {
+			t.Errorf("got %q, want the stale entry", got)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// how many times to try to reconnect to the server before giving up
+	reconnectTries = 20
+	// how long to wait between tries
+	reconnectDelay = 500 * time.Millisecond
+)
+
+// relay passes requests from cmd/go to the server and responses back. It
+// holds on to requests until they're answered, so if the server goes away
+// (e.g. it restarts), it can reconnect with the same build id and send them
+// again. If it can't reconnect, it answers from a local cache instead.
+type relay struct {
+	lock     sync.Mutex
+	cond     *sync.Cond // signaled when inflight shrinks
+	bw       *bufio.Writer
+	je       *json.Encoder // to cmd/go
+	sc       *serverConn
+	sbw      *bufio.Writer
+	sje      *json.Encoder // to server
+	inflight map[int64]*pendingRequest
+	local    *Process // set once we give up on the server
+	cleanup  func()   // cleans up local
+	eof      bool     // cmd/go is done
+
+	reconnecting bool // someone is in reconnect
+
+	stats   clientStats
+	verbose int
+	missed  map[string]time.Time // when gets missed, to estimate build cost
+}
+
+type pendingRequest struct {
+	req  Request
+	body []byte
+}
+
+func runRelay(sc *serverConn, in io.Reader, out io.Writer) error {
+	bw := bufio.NewWriter(out)
+	r := &relay{
+		bw:       bw,
+		je:       json.NewEncoder(bw),
+		inflight: make(map[int64]*pendingRequest),
+		stats:    clientStats{start: time.Now()},
+		verbose:  verbosity(),
+		missed:   make(map[string]time.Time),
+	}
+	r.cond = sync.NewCond(&r.lock)
+	defer func() {
+		if r.cleanup != nil {
+			r.cleanup()
+		}
+	}()
+
+	// pass along the server's list of known commands
+	r.lock.Lock()
+	r.respond(&sc.caps)
+	r.attach(sc)
+	r.lock.Unlock()
+
+	jd := json.NewDecoder(bufio.NewReader(in))
+	for {
+		pr := &pendingRequest{}
+		if err := jd.Decode(&pr.req); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if pr.req.Command == CmdPut && pr.req.BodySize > 0 {
+			if err := jd.Decode(&pr.body); err != nil {
+				return err
+			}
+		}
+		r.lock.Lock()
+		if pr.req.Command == CmdPut {
+			// cmd/go builds an action right after it misses, so this is
+			// roughly how long it took
+			if t, ok := r.missed[string(pr.req.ActionID)]; ok {
+				pr.req.Cost = int64(time.Since(t))
+				delete(r.missed, string(pr.req.ActionID))
+			}
+		}
+		r.inflight[pr.req.ID] = pr
+		r.send(pr)
+		r.lock.Unlock()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for len(r.inflight) > 0 {
+		r.cond.Wait()
+	}
+	r.eof = true
+	if r.sc != nil {
+		r.sc.uc.Close()
+	}
+	return nil
+}
+
+// attach starts using a new server connection. r.lock must be held.
+func (r *relay) attach(sc *serverConn) {
+	r.sc = sc
+	r.sbw = bufio.NewWriter(sc.uc)
+	r.sje = json.NewEncoder(r.sbw)
+	go r.readResponses(sc)
+}
+
+// send sends a request to the server, or answers it locally if we've given up
+// on the server. r.lock must be held.
+func (r *relay) send(pr *pendingRequest) {
+	if r.local != nil {
+		go r.answerLocal(pr)
+	} else if r.sc == nil || r.write(pr) != nil {
+		r.reconnect()
+	}
+}
+
+// write writes a request to the server. r.lock must be held.
+func (r *relay) write(pr *pendingRequest) error {
+	if err := r.sje.Encode(&pr.req); err != nil {
+		return err
+	}
+	if pr.body != nil {
+		if err := r.sje.Encode(pr.body); err != nil {
+			return err
+		}
+	}
+	return r.sbw.Flush()
+}
+
+// respond writes a response to cmd/go. r.lock must be held.
+func (r *relay) respond(res *Response) {
+	r.je.Encode(res)
+	r.bw.Flush()
+}
+
+// finish answers an in-flight request, unless it was already answered (we may
+// get two answers if we resent it after reconnecting). r.lock must be held.
+func (r *relay) finish(res *Response) {
+	pr, ok := r.inflight[res.ID]
+	if !ok {
+		return
+	}
+	delete(r.inflight, res.ID)
+	r.respond(res)
+	r.cond.Broadcast()
+
+	r.stats.record(&pr.req, res)
+	if pr.req.Command == CmdGet && res.Miss {
+		r.missed[string(pr.req.ActionID)] = time.Now()
+	} else if pr.req.Command == CmdClose {
+		r.stats.print(os.Stderr, r.verbose)
+	}
+}
+
+func (r *relay) readResponses(sc *serverConn) {
+	for {
+		line, err := sc.br.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var res Response
+		if err := json.Unmarshal(line, &res); err != nil {
+			log.Println("bad response from server:", err)
+			break
+		}
+		r.lock.Lock()
+		r.finish(&res)
+		r.lock.Unlock()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sc == sc && !r.eof {
+		log.Println("lost connection to server, reconnecting")
+		r.reconnect()
+	}
+}
+
+// reconnect gets a new server connection and resends everything in flight. If
+// that doesn't work, it switches to a local cache. r.lock must be held. It's
+// released while waiting and dialing, so answers keep going to cmd/go.
+func (r *relay) reconnect() {
+	if r.sc != nil {
+		r.sc.uc.Close()
+		r.sc = nil
+	}
+	if r.reconnecting {
+		return // new requests get sent along with the rest once we're back
+	}
+	r.reconnecting = true
+	defer func() { r.reconnecting = false }()
+retry:
+	for try := 0; try < reconnectTries; try++ {
+		r.lock.Unlock()
+		time.Sleep(reconnectDelay)
+		sc, err := initClient()
+		r.lock.Lock()
+		if err != nil {
+			continue
+		}
+		r.attach(sc)
+		for _, pr := range r.inflight {
+			if err := r.write(pr); err != nil {
+				sc.uc.Close()
+				r.sc = nil
+				continue retry
+			}
+		}
+		return
+	}
+
+	log.Println("warning: can't reconnect to server, shared go build cache is off")
+	r.local, r.cleanup = newLocalProcess()
+	for _, pr := range r.inflight {
+		go r.answerLocal(pr)
+	}
+}
+
+func (r *relay) answerLocal(pr *pendingRequest) {
+	req := pr.req
+	// For Go1.23 backward compatibility, as in Process.serve.
+	if len(req.OutputID) == 0 && len(req.ObjectID) != 0 {
+		req.OutputID = req.ObjectID
+	}
+	if pr.body != nil {
+		req.Body = bytes.NewReader(pr.body)
+	}
+	res := &Response{ID: req.ID}
+	if err := r.local.handleRequest(context.Background(), &req, res); err != nil {
+		res.Err = err.Error()
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.finish(res)
+}
@@ -9,7 +9,6 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -47,18 +46,6 @@ func checkIdle(activity chan struct{}, idle time.Duration, fn func()) {
 	}
 }
 
-func cleanBuildDirs(cacheDir string) {
-	ents, err := os.ReadDir(cacheDir)
-	if err != nil {
-		return
-	}
-	for _, ent := range ents {
-		if strings.HasPrefix(ent.Name(), BuildIDPrefix) {
-			os.RemoveAll(filepath.Join(cacheDir, ent.Name()))
-		}
-	}
-}
-
 func isMountedNoatime(dir string) bool {
 	out, err := exec.Command("findmnt", "-T", dir, "-o", "options").Output()
 	if err != nil {
@@ -70,6 +57,11 @@ func isMountedNoatime(dir string) bool {
 func serverMain() {
 	log.SetFlags(log.Lshortfile)
 
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalln("load config:", err)
+	}
+
 	listener, err := getSystemdSocket()
 	if err != nil {
 		log.Fatalln("get listen socket:", err)
@@ -83,12 +75,19 @@ func serverMain() {
 	os.MkdirAll(objDir, 0755)
 	dc := &DiskCache{Dir: objDir, ManualATime: isMountedNoatime(cacheDir)}
 
+	builds := newBuildTracker(cacheDir, dc, cfg)
+	builds.load()
+	go builds.reapLoop()
+
 	exitServer := func() {
-		cleanBuildDirs(cacheDir)
-		dc.Clean(cacheTTL)
+		// leave build dirs alone: the next server adopts them with load and
+		// reaps them when they're done
+		builds.clean(cacheTTL)
 		os.Exit(0)
 	}
 
+	policy := newPeerPolicy(cfg)
+
 	activity := make(chan struct{}, 1)
 	go checkIdle(activity, idleTime, exitServer)
 
@@ -100,24 +99,29 @@ func serverMain() {
 			log.Println("Accept:", err)
 			continue
 		}
+		uid, err := peerUID(conn)
+		if err != nil {
+			log.Println("get peer credentials:", err)
+			conn.Close()
+			continue
+		}
 
 		var p *Process
 		p = &Process{
-			In:       conn,
-			Out:      conn,
-			CacheDir: cacheDir,
-			Get:      dc.Get,
-			Put:      dc.Put,
+			In:      conn,
+			Out:     conn,
+			Builds:  builds,
+			PeerUID: uid,
+			Policy:  policy,
 			Close: func() error {
-				log.Printf("cache: %d gets (%d hits, %d misses, %d errors); %d puts (%d errors)",
-					p.Gets.Load(), p.GetHits.Load(), p.GetMisses.Load(), p.GetErrors.Load(), p.Puts.Load(), p.PutErrors.Load())
+				log.Printf("%s: cache: %s", p.BuildLabel(), p.Stats())
 				return nil
 			},
 		}
 		go func() {
 			err := p.Run()
 			if err != nil {
-				log.Println("run returned", err)
+				log.Println(p.BuildLabel(), "run returned", err)
 			}
 			conn.Close()
 			activity <- struct{}{}
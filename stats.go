@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// env var for how much the client prints about its session: 0 is nothing, 1 is
+// a one-line summary, 2 is more detail. nixGocacheprogHook sets it to 1.
+const verboseEnv = "nixGocacheprogVerbose"
+
+func verbosity() int {
+	v, _ := strconv.Atoi(os.Getenv(verboseEnv))
+	return v
+}
+
+// clientStats are what the client saw of one cmd/go session.
+type clientStats struct {
+	start     time.Time
+	gets      int
+	hits      int
+	misses    int
+	getErrors int
+	hitBytes  int64
+	puts      int
+	putErrors int
+	putBytes  int64
+	saved     time.Duration // build time of actions that were hits, if known
+}
+
+func (s *clientStats) record(req *Request, res *Response) {
+	switch req.Command {
+	case CmdGet:
+		s.gets++
+		if res.Err != "" {
+			s.getErrors++
+		} else if res.Miss {
+			s.misses++
+		} else {
+			s.hits++
+			s.hitBytes += res.Size
+			s.saved += time.Duration(res.Cost)
+		}
+	case CmdPut:
+		s.puts++
+		if res.Err != "" {
+			s.putErrors++
+		} else {
+			s.putBytes += req.BodySize
+		}
+	}
+}
+
+func (s *clientStats) print(w io.Writer, verbose int) {
+	if verbose <= 0 || s.gets+s.puts == 0 {
+		return
+	}
+	fmt.Fprintf(w, "nix-gocacheprog: %d/%d hits (%s), %d puts (%s)",
+		s.hits, s.gets, formatBytes(s.hitBytes), s.puts, formatBytes(s.putBytes))
+	if s.saved > 0 {
+		fmt.Fprintf(w, ", saved ~%s", s.saved.Round(time.Second))
+	}
+	fmt.Fprintln(w)
+	if verbose >= 2 {
+		fmt.Fprintf(w, "nix-gocacheprog: %d misses, %d get errors, %d put errors, session %s\n",
+			s.misses, s.getErrors, s.putErrors, time.Since(s.start).Round(time.Millisecond))
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
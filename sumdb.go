@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// derivation attr (so also env var) with go.sum files to check modules
+// against, before asking the checksum database.
+const goSumEnv = "nixGocacheprogGoSum"
+
+// verifier key for the default GOSUMDB
+const sumGolangOrgKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// sumDB checks modules against a checksum database. It implements
+// sumdb.ClientOps, keeping tiles and lookups in the build cache so they're
+// shared across builds and available offline.
+type sumDB struct {
+	name   string
+	key    string
+	url    string
+	cc     *CacheClient
+	client *sumdb.Client
+	// only use what's cached
+	offline bool
+
+	lock sync.Mutex // for WriteConfig
+}
+
+// newSumDB sets up checking against GOSUMDB, or returns nil if it's off.
+func newSumDB(gosumdb, noSumDB string, cc *CacheClient) (*sumDB, error) {
+	f := strings.Fields(gosumdb)
+	if len(f) == 0 {
+		f = []string{"sum.golang.org"}
+	}
+	if f[0] == "off" {
+		return nil, nil
+	} else if f[0] == "sum.golang.org" {
+		f[0] = sumGolangOrgKey
+	}
+	if len(f) > 2 {
+		return nil, fmt.Errorf("invalid GOSUMDB: too many fields")
+	}
+	name, _, ok := strings.Cut(f[0], "+")
+	if !ok {
+		return nil, fmt.Errorf("invalid GOSUMDB: unknown database %q", f[0])
+	}
+	s := &sumDB{name: name, key: f[0], url: "https://" + name, cc: cc}
+	if len(f) == 2 {
+		s.url = strings.TrimSuffix(f[1], "/")
+	}
+	s.client = sumdb.NewClient(s)
+	s.client.SetGONOSUMDB(noSumDB)
+	return s, nil
+}
+
+// readGoSum reads go.sum files into a map from "path version" to hash.
+func readGoSum(files []string) (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if f := strings.Fields(line); len(f) == 3 {
+				sums[f[0]+" "+f[1]] = f[2]
+			}
+		}
+	}
+	return sums, nil
+}
+
+// verifyModule checks a downloaded .mod or .zip against go.sum or the
+// checksum database. It returns an error wrapping errChecksumMismatch if the
+// file is bad, or some other error if it couldn't be checked.
+func (h *proxyHandler) verifyModule(mod, kind, version string, f *os.File) error {
+	var hash string
+	var err error
+	switch kind {
+	case "zip":
+		hash, err = dirhash.HashZip(f.Name(), dirhash.Hash1)
+	case "mod":
+		version += "/go.mod"
+		hash, err = dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+			return os.Open(f.Name())
+		})
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if want, ok := h.goSum[mod+" "+version]; ok {
+		if hash != want {
+			return fmt.Errorf("%s@%s: %w: downloaded %s, go.sum has %s", mod, version, errChecksumMismatch, hash, want)
+		}
+		return nil
+	} else if h.sumdb == nil {
+		return nil
+	}
+
+	lines, err := h.sumdb.client.Lookup(mod, version)
+	if errors.Is(err, sumdb.ErrGONOSUMDB) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !slices.Contains(lines, mod+" "+version+" "+hash) {
+		return fmt.Errorf("%s@%s: %w: downloaded %s, %s has %q", mod, version, errChecksumMismatch, hash, h.sumdb.name, lines)
+	}
+	return nil
+}
+
+// serveHTTP serves the /sumdb/<name>/ part of the proxy protocol from the
+// cache, so the go command can check sums without going to the database
+// for anything we've already seen.
+func (s *sumDB) serveHTTP(w http.ResponseWriter, rest string) {
+	name, p, _ := strings.Cut(rest, "/")
+	if name != s.name {
+		http.Error(w, "unknown checksum database", http.StatusNotFound)
+		return
+	} else if p == "supported" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	file := s.name + "/" + p
+	var data []byte
+	var err error
+	if p == "latest" {
+		// this changes, so go to the database first
+		if data, err = s.ReadRemote("/" + p); err == nil {
+			s.WriteCache(file, data)
+		} else if data, err = s.ReadCache(file); err == nil {
+			log.Printf("using cached %s", file)
+		}
+	} else if strings.HasPrefix(p, "lookup/") || strings.HasPrefix(p, "tile/") {
+		// these don't change. the go command checks them, so we don't need to
+		if data, err = s.ReadCache(file); err != nil {
+			if data, err = s.ReadRemote("/" + p); err == nil {
+				s.WriteCache(file, data)
+			}
+		}
+	} else {
+		err = errors.New("not found")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
+
+func (s *sumDB) ReadRemote(path string) ([]byte, error) {
+	if s.offline {
+		return nil, fmt.Errorf("offline: %s%s is not cached", s.name, path)
+	}
+	res, err := http.Get(s.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s%s: %s", s.url, path, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *sumDB) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(s.key), nil
+	}
+	// start with an empty tree if we don't have one
+	data, _ := s.read("config/" + file)
+	return data, nil
+}
+
+func (s *sumDB) WriteConfig(file string, old, new []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cur, _ := s.read("config/" + file)
+	if !bytes.Equal(cur, old) {
+		return sumdb.ErrWriteConflict
+	}
+	return s.write("config/"+file, new)
+}
+
+func (s *sumDB) ReadCache(file string) ([]byte, error) {
+	return s.read("cache/" + file)
+}
+
+func (s *sumDB) WriteCache(file string, data []byte) {
+	if err := s.write("cache/"+file, data); err != nil {
+		log.Println("sumdb cache write", file, err)
+	}
+}
+
+func (s *sumDB) Log(msg string) {
+	log.Println(msg)
+}
+
+func (s *sumDB) SecurityError(msg string) {
+	// the client returns ErrSecurity, which fails the check
+	log.Println("SECURITY ERROR", msg)
+}
+
+func sumDBActionID(key string) []byte {
+	hsh := sha256.New()
+	fmt.Fprintf(hsh, "sumdb v1\n")
+	fmt.Fprintf(hsh, "key=%s\n", key)
+	return hsh.Sum(nil)[:proxyCacheKeyBytes]
+}
+
+func (s *sumDB) read(key string) ([]byte, error) {
+	res, err := s.cc.get(sumDBActionID(key))
+	if err != nil {
+		return nil, err
+	} else if res.Err != "" {
+		return nil, errors.New(res.Err)
+	} else if res.Miss || res.DiskPath == "" {
+		return nil, errors.New("cache miss")
+	}
+	return os.ReadFile(res.DiskPath)
+}
+
+func (s *sumDB) write(key string, data []byte) error {
+	objectID := sha256.Sum256(data)
+	res, err := s.cc.put(sumDBActionID(key), objectID[:proxyCacheKeyBytes], int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return err
+	} else if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// upstream is one place the module proxy can get files from.
+type upstream interface {
+	// fetch gets a proxy path like /golang.org/x/mod/@v/list. Not found is
+	// reported as a 404 response, not an error.
+	fetch(ctx context.Context, path string) (*http.Response, error)
+	String() string
+}
+
+// proxySpec is one entry in GOPROXY.
+type proxySpec struct {
+	up upstream
+	// whether to try the next entry on any error (it was followed by "|"),
+	// or only on not found (it was followed by ",")
+	fallBackOnError bool
+}
+
+// parseGoproxy parses GOPROXY the same way the go command does: entries are
+// separated by "," or "|", "direct" and "off" end the list, and entries that
+// don't look like URLs get https:// added.
+func parseGoproxy(goproxy string) ([]proxySpec, error) {
+	var specs []proxySpec
+	for goproxy != "" {
+		var entry string
+		fallBackOnError := false
+		if i := strings.IndexAny(goproxy, ",|"); i >= 0 {
+			entry = goproxy[:i]
+			fallBackOnError = goproxy[i] == '|'
+			goproxy = goproxy[i+1:]
+		} else {
+			entry, goproxy = goproxy, ""
+		}
+
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
+			continue
+		case "direct":
+			// nothing after direct or off is ever used
+			return append(specs, proxySpec{up: newDirectUpstream()}), nil
+		case "off":
+			return append(specs, proxySpec{up: offUpstream{}}), nil
+		}
+
+		// single words are reserved for built-in behaviors, anything else
+		// without a scheme is a host name
+		if !strings.Contains(entry, ":/") && !path.IsAbs(entry) {
+			entry = "https://" + entry
+		}
+		u, err := url.Parse(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GOPROXY entry %q: %w", entry, err)
+		}
+		var up upstream
+		switch u.Scheme {
+		case "http", "https":
+			up = httpUpstream{base: u}
+		case "file":
+			up = fileUpstream{dir: filepath.FromSlash(u.Path)}
+		default:
+			return nil, fmt.Errorf("invalid GOPROXY entry %q: unsupported scheme %q", entry, u.Scheme)
+		}
+		specs = append(specs, proxySpec{up: up, fallBackOnError: fallBackOnError})
+	}
+	return specs, nil
+}
+
+// most requests we make to one upstream host at once
+const maxPerHost = 8
+
+var hostSlots = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+type httpUpstream struct {
+	base *url.URL
+}
+
+func (u httpUpstream) fetch(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.base.JoinPath(path).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hostSlots.Lock()
+	slots := hostSlots.m[u.base.Host]
+	if slots == nil {
+		slots = make(chan struct{}, maxPerHost)
+		hostSlots.m[u.base.Host] = slots
+	}
+	hostSlots.Unlock()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	// hold the slot until the body is read
+	res.Body = &releaseBody{ReadCloser: res.Body, release: func() { <-slots }}
+	return res, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func (u httpUpstream) String() string { return u.base.String() }
+
+// fileUpstream serves a directory laid out like a module proxy, e.g. the
+// cache/download directory of a module cache.
+type fileUpstream struct {
+	dir string
+}
+
+func (u fileUpstream) fetch(ctx context.Context, p string) (*http.Response, error) {
+	f, err := os.Open(filepath.Join(u.dir, filepath.FromSlash(path.Clean("/"+p))))
+	if errors.Is(err, os.ErrNotExist) {
+		return textResponse(http.StatusNotFound, "not found: "+p), nil
+	} else if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	} else if fi.IsDir() {
+		f.Close()
+		return textResponse(http.StatusNotFound, "not found: "+p), nil
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": {strconv.FormatInt(fi.Size(), 10)}},
+		ContentLength: fi.Size(),
+		Body:          f,
+	}, nil
+}
+
+func (u fileUpstream) String() string { return "file://" + filepath.ToSlash(u.dir) }
+
+// offUpstream stands in for "off", which disallows any further lookups.
+type offUpstream struct{}
+
+func (offUpstream) fetch(ctx context.Context, path string) (*http.Response, error) {
+	return textResponse(http.StatusForbidden, "module lookup disabled by GOPROXY=off"), nil
+}
+
+func (offUpstream) String() string { return "off" }
+
+func textResponse(code int, msg string) *http.Response {
+	msg += "\n"
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Length": {strconv.Itoa(len(msg))}},
+		ContentLength: int64(len(msg)),
+		Body:          io.NopCloser(strings.NewReader(msg)),
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	// one server pretends to be several upstreams, named by the first path
+	// element: "ok", or a status code to answer with
+	var lock sync.Mutex
+	var hits []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		lock.Lock()
+		hits = append(hits, name)
+		lock.Unlock()
+		if name == "ok" {
+			io.WriteString(w, "from ok")
+			return
+		}
+		code, _ := strconv.Atoi(name)
+		http.Error(w, "from "+name, code)
+	}))
+	defer srv.Close()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "x.com/a/@v"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "x.com/a/@v/list"), []byte("from file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// direct can't find anything, since the repo doesn't exist
+	t.Setenv(reposEnv, "x.com/a="+filepath.Join(dir, "nothing.git"))
+
+	up := func(name string) string { return srv.URL + "/" + name }
+	const path = "/x.com/a/@v/list"
+
+	for _, tc := range []struct {
+		name     string
+		goproxy  string
+		private  string
+		noProxy  string
+		path     string
+		wantCode int // 0 for an error
+		wantBody string
+		wantHits []string
+	}{
+		{"ok", up("ok"), "", "", path, 200, "from ok", []string{"ok"}},
+		{"comma 404", up("404") + "," + up("ok"), "", "", path, 200, "from ok", []string{"404", "ok"}},
+		{"comma 410", up("410") + "," + up("ok"), "", "", path, 200, "from ok", []string{"410", "ok"}},
+		{"comma 500", up("500") + "," + up("ok"), "", "", path, 500, "from 500", []string{"500"}},
+		{"comma 403", up("403") + "," + up("ok"), "", "", path, 403, "from 403", []string{"403"}},
+		{"comma dead", dead.URL + "," + up("ok"), "", "", path, 0, "", nil},
+		{"pipe 404", up("404") + "|" + up("ok"), "", "", path, 200, "from ok", []string{"404", "ok"}},
+		{"pipe 500", up("500") + "|" + up("ok"), "", "", path, 200, "from ok", []string{"500", "ok"}},
+		{"pipe dead", dead.URL + "|" + up("ok"), "", "", path, 200, "from ok", []string{"ok"}},
+		{"mixed", up("404") + "," + up("500") + "|" + up("410") + "," + up("ok"), "", "", path, 200, "from ok", []string{"404", "500", "410", "ok"}},
+		{"last fails", up("404") + "," + up("410"), "", "", path, 410, "from 410", []string{"404", "410"}},
+		{"off", "off", "", "", path, 403, "", nil},
+		{"off ends list", up("404") + ",off," + up("ok"), "", "", path, 403, "", []string{"404"}},
+		{"file", "file://" + filepath.ToSlash(dir), "", "", path, 200, "from file", nil},
+		{"file missing", "file://" + filepath.ToSlash(dir) + "," + up("ok"), "", "", "/x.com/b/@v/list", 200, "from ok", []string{"ok"}},
+		{"direct", up("404") + ",direct," + up("ok"), "", "", path, 404, "", []string{"404"}},
+		{"private", up("500"), up("404") + "," + up("ok"), "x.com/a", path, 200, "from ok", []string{"404", "ok"}},
+		{"private glob", up("500"), up("ok"), "*.com", path, 200, "from ok", []string{"ok"}},
+		{"not private", up("ok"), up("500"), "x.com/b", path, 200, "from ok", []string{"ok"}},
+		{"private off", up("ok"), "off", "x.com/a", path, 403, "", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lock.Lock()
+			hits = nil
+			lock.Unlock()
+
+			proxies, err := parseGoproxy(tc.goproxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			private, err := parseGoproxy(cmp.Or(tc.private, "off"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &proxyHandler{proxies: proxies, private: private, noProxy: tc.noProxy}
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			res, err := h.fetch(req, tc.path)
+			if tc.wantCode == 0 {
+				if err == nil {
+					res.Body.Close()
+					t.Fatalf("got %s, want error", res.Status)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				body, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				if res.StatusCode != tc.wantCode {
+					t.Errorf("got status %d, want %d", res.StatusCode, tc.wantCode)
+				}
+				if tc.wantBody != "" && strings.TrimSpace(string(body)) != tc.wantBody {
+					t.Errorf("got body %q, want %q", body, tc.wantBody)
+				}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if !slices.Equal(hits, tc.wantHits) {
+				t.Errorf("asked %q, want %q", hits, tc.wantHits)
+			}
+		})
+	}
+}
+
+func TestParseGoproxy(t *testing.T) {
+	for _, tc := range []struct {
+		goproxy string
+		want    []string // upstreams, with "|" after ones that fall back on errors
+	}{
+		{"https://proxy.golang.org,direct", []string{"https://proxy.golang.org", "direct"}},
+		{"proxy.example.com|direct", []string{"https://proxy.example.com|", "direct"}},
+		{"direct,https://proxy.golang.org", []string{"direct"}},
+		{"off", []string{"off"}},
+		{"a.com, ,b.com", []string{"https://a.com", "https://b.com"}},
+		{"file:///tmp/cache", []string{"file:///tmp/cache"}},
+	} {
+		specs, err := parseGoproxy(tc.goproxy)
+		if err != nil {
+			t.Errorf("%q: %v", tc.goproxy, err)
+			continue
+		}
+		var got []string
+		for _, s := range specs {
+			if s.fallBackOnError {
+				got = append(got, s.up.String()+"|")
+			} else {
+				got = append(got, s.up.String())
+			}
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.goproxy, got, tc.want)
+		}
+	}
+
+	if _, err := parseGoproxy("ftp://example.com"); err == nil {
+		t.Error("ftp: want error")
+	}
+}
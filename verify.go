@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// subdirectory of the build dir for outputs that didn't match the cache
+	verifyDir = "verify"
+	// subdirectory of the cache dir for verification reports
+	reportDir = "verify-reports"
+)
+
+// verifyMismatch is one put that didn't match what was already in the cache.
+type verifyMismatch struct {
+	ActionID       string
+	CachedOutputID string
+	OutputID       string
+	SameOutputID   bool `json:",omitempty"` // outputs had the same id but different contents
+}
+
+// verifyPut returns a Put func for verify mode. Instead of overwriting what the
+// cache has for an action, it compares the new output against it and records
+// any difference. Actions that aren't in the cache yet are passed to next.
+func (p *Process) verifyPut(
+	dc *DiskCache,
+	next func(ctx context.Context, actionID, outputID string, size int64, r io.Reader) (string, error),
+) func(ctx context.Context, actionID, outputID string, size int64, r io.Reader) (string, error) {
+	private := &DiskCache{Dir: filepath.Join(p.buildDir, verifyDir)}
+	return func(ctx context.Context, actionID, outputID string, size int64, r io.Reader) (string, error) {
+		cachedOutputID, cachedPath, err := dc.Get(ctx, actionID)
+		if err != nil {
+			return "", err
+		}
+		var cached []byte
+		if cachedOutputID != "" {
+			// if the output was evicted or can't be read, there's nothing to
+			// compare against, so treat it as a miss
+			if cached, err = os.ReadFile(cachedPath); err != nil {
+				cachedOutputID = ""
+			}
+		}
+		if cachedOutputID == "" {
+			if next == nil {
+				if err := os.MkdirAll(private.Dir, 0o755); err != nil {
+					return "", err
+				}
+				return private.Put(ctx, actionID, outputID, size, r)
+			}
+			return next(ctx, actionID, outputID, size, r)
+		}
+
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		p.Builds.verified(p.build)
+		if cachedOutputID == outputID && bytes.Equal(cached, body) {
+			return cachedPath, nil
+		}
+
+		m := verifyMismatch{
+			ActionID:       actionID,
+			CachedOutputID: cachedOutputID,
+			OutputID:       outputID,
+			SameOutputID:   cachedOutputID == outputID,
+		}
+		p.Builds.mismatch(p.build, m)
+		log.Printf("%s: verify mismatch: action %s was %s, now %s", p.BuildLabel(), actionID, cachedOutputID, outputID)
+		if p.Builds.verifyFail {
+			return "", fmt.Errorf("cache verification failed for action %s", actionID)
+		}
+		// cmd/go still needs its own output on disk
+		if err := os.MkdirAll(private.Dir, 0o755); err != nil {
+			return "", err
+		}
+		return private.Put(ctx, actionID, outputID, size, bytes.NewReader(body))
+	}
+}
+
+// writeVerifyReport writes the verification results for a finished build to
+// the report dir.
+func (bt *buildTracker) writeVerifyReport(b *buildState) error {
+	dir := filepath.Join(bt.cacheDir, reportDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	rj, err := json.MarshalIndent(struct {
+		BuildID    string
+		Name       string
+		DrvPath    string
+		Time       time.Time
+		Verified   int
+		Mismatches []verifyMismatch
+	}{b.id, b.name, b.drvPath, time.Now(), b.verifiedPuts, b.mismatches}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writeAtomic(filepath.Join(dir, b.id+".json"), bytes.NewReader(rj))
+	return err
+}
@@ -7,7 +7,10 @@
 // the cache interface.
 package main
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // Cmd is a command that can be issued to a child process.
 //
@@ -56,6 +59,11 @@ type Request struct {
 
 	// BodySize is the number of bytes of Body. If zero, the body isn't written.
 	BodySize int64 `json:",omitempty"`
+
+	// --- protocol extension
+	// Cost is how long the client thinks the action took to build, in
+	// nanoseconds, for "put".
+	Cost int64 `json:",omitempty"`
 }
 
 // Response is the JSON response from the child process to cmd/go.
@@ -90,14 +98,64 @@ type Response struct {
 	// a "get" request's ActionID (on cache hit) or a "put" request's
 	// provided OutputID.
 	DiskPath string `json:",omitempty"`
+
+	// --- protocol extension
+	// Cost is how long the action took to build when it was put, in
+	// nanoseconds, for "get" hits.
+	Cost int64 `json:",omitempty"`
 }
 
 // --- protocol extension
 type Hello struct {
 	BuildID string
-	Phase   string // "hook" or "build"
+	Phase   string // "hook", "build", "done", or "list"
+	DrvPath string `json:",omitempty"` // derivation path, for "hook" and "done"
+	Name    string `json:",omitempty"` // derivation pname or name, for "hook"
+	Sandbox string `json:",omitempty"` // sandbox root, for "hook"
+	Success bool   `json:",omitempty"` // build succeeded, for "done"
+	Access  Access `json:",omitempty"` // requested access, for "build"
+
+	// Options are nixGocacheprog* derivation attrs, with the prefix removed,
+	// for "hook".
+	Options map[string]string `json:",omitempty"`
 }
 
+// Access is what a connection may do with the cache. Empty means read-write.
+type Access string
+
+const (
+	AccessReadWrite = Access("read-write")
+	AccessReadOnly  = Access("read-only")
+	AccessWriteOnly = Access("write-only")
+)
+
+func (a Access) Valid() bool {
+	return a == "" || a == AccessReadWrite || a == AccessReadOnly || a == AccessWriteOnly
+}
+
+func (a Access) CanRead() bool  { return a != AccessWriteOnly }
+func (a Access) CanWrite() bool { return a != AccessReadOnly }
+
 type HookResponse struct {
 	BuildDir string
 }
+
+// ModuleInfo describes a cached module version, in response to "modules".
+type ModuleInfo struct {
+	Module  string
+	Version string
+	Files   []string // .info, .mod, .zip
+	Size    int64
+}
+
+// BuildInfo describes an active build, in response to "list".
+type BuildInfo struct {
+	BuildID string
+	Name    string `json:",omitempty"`
+	DrvPath string `json:",omitempty"`
+	Started time.Time
+	Conns   int
+	Done    bool `json:",omitempty"`
+	Verify  bool `json:",omitempty"`
+	Stats   cacheStats
+}